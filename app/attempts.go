@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// segmentAttempt is one request to transcode a segment, saved to segment_attempts for debugging broadcasters
+type segmentAttempt struct {
+	broadcaster   string
+	started       time.Time
+	ended         time.Time
+	httpStatus    int
+	err           error
+	bytesSent     int64
+	bytesReceived int64
+	parts         map[string]string
+}
+
+// saveAttempt records the attempt, failing to record it does not fail the segment
+func (f *FfmpegTranscode) saveAttempt(segment *models.Record, a *segmentAttempt) {
+	collection, err := f.pApp.Dao().FindCollectionByNameOrId("segment_attempts")
+	if err != nil {
+		ErrorLogger.Printf("%v could not find segment_attempts: %v\n", f.RequestId, err.Error())
+		return
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("segment", segment.Id)
+	record.Set("transcode", f.RequestId)
+	record.Set("attempt", segment.GetInt("attempts"))
+	record.Set("broadcaster", a.broadcaster)
+	record.Set("started", a.started)
+	record.Set("ended", a.ended)
+	record.Set("http_status", a.httpStatus)
+	record.Set("bytes_sent", a.bytesSent)
+	record.Set("bytes_received", a.bytesReceived)
+	record.Set("parts", a.parts)
+	if a.err != nil {
+		record.Set("error_class", f.errorClass(a))
+		record.Set("error", a.err.Error())
+	}
+	if err := f.pApp.Dao().SaveRecord(record); err != nil {
+		ErrorLogger.Printf("%v segment %v could not save attempt: %v\n", f.RequestId, segment.GetString("num"), err.Error())
+	}
+}
+
+// errorClass groups the failure of an attempt, e.g. to tell busy broadcasters from unreachable ones
+func (f *FfmpegTranscode) errorClass(a *segmentAttempt) string {
+	var busyErr *broadcasterBusyError
+	var netErr net.Error
+	switch {
+	case f.paused():
+		return "paused"
+	case f.ctx.Err() != nil:
+		return "cancelled"
+	case errors.Is(a.err, errNoBroadcaster):
+		return "no_broadcaster"
+	case errors.As(a.err, &busyErr):
+		return "busy"
+	case !retryable(a.err):
+		return "permanent"
+	case a.broadcaster == "local":
+		return "local"
+	case errors.Is(a.err, context.DeadlineExceeded) || (errors.As(a.err, &netErr) && netErr.Timeout()):
+		return "timeout"
+	case a.httpStatus == 0:
+		return "network"
+	case a.httpStatus != 200:
+		return "http"
+	}
+
+	return "response"
+}
+
+// countingReader counts the bytes read through it, the count can be read while the transport reads a request body
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// broadcasterPool tracks the health and load of the broadcasters shared by all transcodes
+var broadcasterPool = NewBroadcasterPool()
+
+const (
+	//failures in a row before a broadcaster is taken out
+	broadcasterMaxFails     = 3
+	broadcasterCoolOff      = time.Minute
+	broadcasterMaxCool      = 10 * time.Minute
+	broadcasterProbeTimeout = 5 * time.Second
+	//segments sent to a broadcaster at one time when it has no max in flight set
+	defaultMaxInFlight = 5
+	//longest wait between checks for a free slot, a slot freeing up wakes waiting segments sooner
+	broadcasterSlotWait = 5 * time.Second
+	//times a segment is sent again after a broadcaster is busy, and the longest it waits
+	maxBusyRetries    = 10
+	defaultRetryAfter = 5 * time.Second
+	maxRetryAfter     = 2 * time.Minute
+)
+
+type BroadcasterPool struct {
+	mu           sync.Mutex
+	broadcasters []*Broadcaster
+	stats        map[string]*broadcasterStats
+	rr           int
+	//closed and replaced when a slot frees up
+	changed chan struct{}
+}
+
+type broadcasterStats struct {
+	outstanding int
+	successes   int
+	failures    int
+	//moving averages, success rate 0-1 and seconds of request per second of video
+	successRate float64
+	latency     float64
+	failsInRow  int
+	downUntil   time.Time
+	retryAt     time.Time
+}
+
+func NewBroadcasterPool() *BroadcasterPool {
+	return &BroadcasterPool{stats: make(map[string]*broadcasterStats), changed: make(chan struct{})}
+}
+
+// signal wakes the segments waiting for a slot, must hold mu
+func (p *BroadcasterPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+func (b *Broadcaster) maxInFlight() int {
+	if b.MaxInFlight > 0 {
+		return b.MaxInFlight
+	}
+	return defaultMaxInFlight
+}
+
+// set replaces the broadcasters, stats are kept for broadcasters still in the pool
+func (p *BroadcasterPool) set(broadcasters []*Broadcaster) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.broadcasters = broadcasters
+	p.signal()
+}
+
+func (p *BroadcasterPool) list() []*Broadcaster {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.broadcasters
+}
+
+// get returns the stats for the broadcaster, must hold mu
+func (p *BroadcasterPool) get(b *Broadcaster) *broadcasterStats {
+	key := b.Url.String()
+	s, ok := p.stats[key]
+	if !ok {
+		s = &broadcasterStats{successRate: 1, latency: 1}
+		p.stats[key] = s
+	}
+
+	return s
+}
+
+// acquire waits for a broadcaster with a free slot to send the next segment to, nil if every broadcaster has been
+// tried or is cooling off.
+func (p *BroadcasterPool) acquire(ctx context.Context, tried map[*Broadcaster]bool) *Broadcaster {
+	for {
+		p.mu.Lock()
+		b, wait := p.pick(tried)
+		changed := p.changed
+		p.mu.Unlock()
+		if b != nil || wait == 0 {
+			return b
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-changed:
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+		timer.Stop()
+	}
+}
+
+// pick takes a slot on the broadcaster to send the next segment to, must hold mu.
+// Broadcasters are weighted by their weight, success rate and latency and loaded by the segments they have in flight.
+// If none are free the wait is how long until one may be, 0 if there are none left to try.
+func (p *BroadcasterPool) pick(tried map[*Broadcaster]bool) (*Broadcaster, time.Duration) {
+	broadcasters := p.broadcasters
+	var pick *Broadcaster
+	var wait time.Duration
+	best := math.MaxFloat64
+	now := time.Now()
+	//start at the next broadcaster each time so equal scores take turns
+	p.rr++
+	for i := range broadcasters {
+		b := broadcasters[(p.rr+i)%len(broadcasters)]
+		s := p.get(b)
+		if tried[b] || now.Before(s.downUntil) {
+			continue
+		}
+		//full or asked us to back off, wait for a slot
+		if now.Before(s.retryAt) {
+			if until := s.retryAt.Sub(now); wait == 0 || until < wait {
+				wait = until
+			}
+			continue
+		}
+		if s.outstanding >= b.maxInFlight() {
+			if wait == 0 || broadcasterSlotWait < wait {
+				wait = broadcasterSlotWait
+			}
+			continue
+		}
+		weight := float64(max(b.Weight, 1)) * math.Max(s.successRate, 0.1)
+		score := float64(s.outstanding+1) * math.Max(s.latency, 0.1) / weight
+		if score < best {
+			pick = b
+			best = score
+		}
+	}
+	if pick != nil {
+		p.get(pick).outstanding++
+	}
+
+	return pick, wait
+}
+
+// backoff frees the slot of a broadcaster that was too busy for the segment and holds new segments until retryAfter
+func (p *BroadcasterPool) backoff(b *Broadcaster, retryAfter time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.get(b)
+	s.outstanding--
+	s.retryAt = time.Now().Add(retryAfter)
+	p.signal()
+}
+
+// done records the result of a segment sent to the broadcaster
+func (p *BroadcasterPool) done(b *Broadcaster, took time.Duration, videoSecs float64, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	s := p.get(b)
+	s.outstanding--
+	p.signal()
+	if ok {
+		s.successes++
+		s.successRate = s.successRate*0.8 + 0.2
+		if videoSecs > 0 {
+			s.latency = s.latency*0.8 + 0.2*(took.Seconds()/videoSecs)
+		}
+		s.failsInRow = 0
+		s.downUntil = time.Time{}
+		return
+	}
+
+	s.failures++
+	s.successRate = s.successRate * 0.8
+	s.failsInRow++
+	if s.failsInRow >= broadcasterMaxFails {
+		p.coolOff(b, s)
+	}
+}
+
+// release frees the broadcaster without recording a result, e.g. the transcode was cancelled
+func (p *BroadcasterPool) release(b *Broadcaster) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.get(b).outstanding--
+	p.signal()
+}
+
+// coolOff takes the broadcaster out, longer each time it fails again, must hold mu
+func (p *BroadcasterPool) coolOff(b *Broadcaster, s *broadcasterStats) {
+	cool := broadcasterCoolOff * time.Duration(1<<min(max(s.failsInRow-broadcasterMaxFails, 0), 4))
+	if cool > broadcasterMaxCool {
+		cool = broadcasterMaxCool
+	}
+	s.downUntil = time.Now().Add(cool)
+	ErrorLogger.Printf("broadcaster %v unhealthy (success rate %.2f), cooling off for %v\n", b.Url.String(), s.successRate, cool)
+}
+
+// probe checks each broadcaster answers, broadcasters that do not are taken out and ones that answer again are put back
+func (p *BroadcasterPool) probe() {
+	for _, b := range p.list() {
+		healthy := probeBroadcaster(b)
+
+		p.mu.Lock()
+		s := p.get(b)
+		down := time.Now().Before(s.downUntil)
+		if !healthy && !down {
+			s.failsInRow = max(s.failsInRow, broadcasterMaxFails)
+			p.coolOff(b, s)
+		} else if healthy && down {
+			s.failsInRow = 0
+			s.downUntil = time.Time{}
+			InfoLogger.Printf("broadcaster %v healthy again\n", b.Url.String())
+		}
+		InfoLogger.Printf("broadcaster %v: %v in flight, %v ok, %v failed, success rate %.2f, latency %.2fs per video second\n", b.Url.String(), s.outstanding, s.successes, s.failures, s.successRate, s.latency)
+		p.mu.Unlock()
+	}
+}
+
+// probeBroadcaster returns true if the broadcaster host answers without a server error
+func probeBroadcaster(b *Broadcaster) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), broadcasterProbeTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", b.Url.Scheme+"://"+b.Url.Host+"/", nil)
+	if err != nil {
+		return false
+	}
+	resp, err := broadcasterClient.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode < 500
+}
+
+// setupBroadcasters loads the broadcasters into the pool at start and again when they are changed
+func setupBroadcasters(app *pocketbase.PocketBase) {
+	var fake FakeBroadcaster
+	var useFake bool
+	var fakeLatency int
+	app.RootCmd.PersistentFlags().BoolVar(&useFake, "fakeBroadcaster", false, "add an in-process fake broadcaster that returns the segment as each rendition, for running offline")
+	app.RootCmd.PersistentFlags().IntVar(&fakeLatency, "fakeLatency", 500, "milliseconds the fake broadcaster takes to answer a segment")
+	app.RootCmd.PersistentFlags().Float64Var(&fake.ErrorRate, "fakeErrorRate", 0, "fraction of segments the fake broadcaster fails (0-1)")
+	app.RootCmd.PersistentFlags().IntVar(&fake.ErrorStatus, "fakeErrorStatus", 503, "http status of fake broadcaster failures")
+	app.RootCmd.PersistentFlags().IntVar(&fake.RetryAfter, "fakeRetryAfter", 0, "Retry-After seconds sent with fake broadcaster 503s")
+
+	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
+		if useFake {
+			fake.Latency = time.Duration(fakeLatency) * time.Millisecond
+			useFakeBroadcaster(&fake)
+		}
+		if err := importBroadcastersList(app); err != nil {
+			ErrorLogger.Printf("could not import broadcasters.list: %v\n", err.Error())
+		}
+		return loadBroadcasters(app)
+	})
+
+	reload := func(e *core.ModelEvent) error {
+		if err := loadBroadcasters(app); err != nil {
+			ErrorLogger.Printf("could not reload broadcasters: %v\n", err.Error())
+		}
+		return nil
+	}
+	app.OnModelAfterCreate("broadcasters").Add(reload)
+	app.OnModelAfterUpdate("broadcasters").Add(reload)
+	app.OnModelAfterDelete("broadcasters").Add(reload)
+}
+
+// loadBroadcasters puts the enabled broadcasters in the pool
+func loadBroadcasters(app *pocketbase.PocketBase) error {
+	broadcasters, err := getBroadcasters(app)
+	if err != nil {
+		return err
+	}
+	if fakeBroadcaster != nil {
+		broadcasters = append(broadcasters, fakeBroadcaster.broadcaster())
+	}
+	broadcasterPool.set(broadcasters)
+	InfoLogger.Printf("%v broadcasters enabled\n", len(broadcasters))
+
+	return nil
+}
+
+func getBroadcasters(app *pocketbase.PocketBase) ([]*Broadcaster, error) {
+	records, err := app.Dao().FindRecordsByFilter("broadcasters", "enabled = true", "+created", 0, 0)
+	if err != nil {
+		return nil, errors.New("could not get broadcasters")
+	}
+
+	var broadcasters []*Broadcaster
+	for _, r := range records {
+		u, err := url.ParseRequestURI(r.GetString("url"))
+		if err != nil {
+			ErrorLogger.Printf("broadcaster %v - could not parse url: %v\n", r.Id, r.GetString("url"))
+			continue
+		}
+		broadcasters = append(broadcasters, &Broadcaster{
+			Url:         u,
+			User:        r.GetString("username"),
+			Password:    r.GetString("password"),
+			Weight:      r.GetInt("weight"),
+			Region:      r.GetString("region"),
+			MaxInFlight: r.GetInt("max_concurrency"),
+		})
+	}
+
+	return broadcasters, nil
+}
+
+// importBroadcastersList adds the broadcasters in broadcasters.list (url|user|password per line, auth optional) to the
+// broadcasters collection, the file is renamed after so it is only imported once
+func importBroadcastersList(app *pocketbase.PocketBase) error {
+	listFile := app.DataDir() + "/broadcasters.list"
+	rf, err := os.Open(listFile)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer rf.Close()
+
+	collection, err := app.Dao().FindCollectionByNameOrId("broadcasters")
+	if err != nil {
+		return err
+	}
+
+	imported := 0
+	scanner := bufio.NewScanner(rf)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, "|")
+		if _, err := url.ParseRequestURI(fields[0]); err != nil {
+			ErrorLogger.Printf("broadcasters.list line %v - could not parse url, not imported\n", lineNum)
+			continue
+		}
+		if len(fields) > 3 {
+			ErrorLogger.Printf("broadcasters.list line %v - expected url|user|password, not imported\n", lineNum)
+			continue
+		}
+		if existing, _ := app.Dao().FindFirstRecordByData("broadcasters", "url", fields[0]); existing != nil {
+			continue
+		}
+
+		record := models.NewRecord(collection)
+		record.Set("url", fields[0])
+		if len(fields) > 1 {
+			record.Set("username", fields[1])
+		}
+		if len(fields) > 2 {
+			record.Set("password", fields[2])
+		}
+		record.Set("weight", 1)
+		record.Set("enabled", true)
+		if err := app.Dao().SaveRecord(record); err != nil {
+			return errors.New(fmt.Sprintf("could not save broadcaster from line %v: %v", lineNum, err.Error()))
+		}
+		imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	rf.Close()
+	if err := os.Rename(listFile, listFile+".imported"); err != nil {
+		return err
+	}
+	InfoLogger.Printf("imported %v broadcasters from broadcasters.list\n", imported)
+
+	return nil
+}
+
+// broadcasterView is the broadcaster record returned by the admin routes, the password is not returned
+func broadcasterView(r *models.Record) map[string]any {
+	view := r.PublicExport()
+	delete(view, "password")
+	view["has_password"] = r.GetString("password") != ""
+
+	return view
+}
+
+// broadcasterBusyError is returned when a broadcaster has no room for the segment (503 or 429)
+type broadcasterBusyError struct {
+	url        string
+	retryAfter time.Duration
+}
+
+func (e *broadcasterBusyError) Error() string {
+	return fmt.Sprintf("broadcaster %v busy, retry after %v", e.url, e.retryAfter)
+}
+
+// parseRetryAfter reads a Retry-After header in seconds or as a date
+func parseRetryAfter(header string) time.Duration {
+	retryAfter := defaultRetryAfter
+	if secs, err := strconv.Atoi(strings.TrimSpace(header)); err == nil && secs >= 0 {
+		retryAfter = time.Duration(secs) * time.Second
+	} else if t, err := http.ParseTime(header); err == nil {
+		retryAfter = time.Until(t)
+	}
+
+	if retryAfter < time.Second {
+		retryAfter = time.Second
+	}
+	if retryAfter > maxRetryAfter {
+		retryAfter = maxRetryAfter
+	}
+
+	return retryAfter
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// cancelTranscode stops a transcode, a running transcode aborts its requests and removes its files when it stops
+func cancelTranscode(app *pocketbase.PocketBase, t *models.Record) error {
+	switch t.GetString("status") {
+	case "complete", "partial", "error", "cancelled":
+		return errors.New("transcode is already " + t.GetString("status"))
+	}
+
+	if running, ok := runningTranscodes.Load(t.Id); ok {
+		running.(*FfmpegTranscode).cancel()
+	}
+	t.Set("status", "cancelled")
+	t.Set("status_message", "cancelled by user")
+	if err := app.Dao().SaveRecord(t); err != nil {
+		ErrorLogger.Printf("%v could not save cancelled status: %v\n", t.Id, err.Error())
+		return errors.New("could not cancel transcode")
+	}
+	InfoLogger.Printf("%v transcode cancelled\n", t.Id)
+
+	running, ok := runningTranscodes.Load(t.Id)
+	//a transcode stopping for a pause keeps its files, remove them once it has stopped
+	if ok && running.(*FfmpegTranscode).paused() && running.(*FfmpegTranscode).waitStopped() {
+		ok = false
+	}
+	if !ok {
+		f := &FfmpegTranscode{WorkDir: app.DataDir() + "/videos/segments", RequestId: t.Id, pApp: app}
+		f.cleanupFiles()
+	}
+
+	return nil
+}
+
+// pauseTranscode holds a transcode, a running transcode stops so its job worker can run other transcodes
+func pauseTranscode(app *pocketbase.PocketBase, t *models.Record) error {
+	switch t.GetString("status") {
+	case "queued", "in_progress":
+	default:
+		return errors.New("only queued or in progress transcodes can be paused")
+	}
+
+	if running, ok := runningTranscodes.Load(t.Id); ok {
+		running.(*FfmpegTranscode).pause()
+	}
+	t.Set("status", "paused")
+	t.Set("status_message", "paused by user")
+	if err := app.Dao().SaveRecord(t); err != nil {
+		ErrorLogger.Printf("%v could not save paused status: %v\n", t.Id, err.Error())
+		return errors.New("could not pause transcode")
+	}
+	InfoLogger.Printf("%v transcode paused\n", t.Id)
+
+	return nil
+}
+
+// resumeTranscode queues a paused transcode to start again from its saved segments
+func resumeTranscode(app *pocketbase.PocketBase, t *models.Record) error {
+	if running, ok := runningTranscodes.Load(t.Id); ok {
+		rf := running.(*FfmpegTranscode)
+		if !rf.paused() {
+			if rf.ctx.Err() != nil {
+				return errors.New("transcode is cancelled")
+			}
+			return errors.New("transcode is not paused")
+		}
+		//wait for the transcode to stop before queuing it, it may save its status while stopping
+		if !rf.waitStopped() {
+			return errors.New("transcode is still pausing, try again")
+		}
+		saved, err := app.Dao().FindRecordById("transcodes", t.Id)
+		if err != nil {
+			return errors.New("could not resume transcode")
+		}
+		t = saved
+	}
+	if t.GetString("status") != "paused" {
+		return errors.New("transcode is not paused")
+	}
+
+	t.Set("status", "queued")
+	t.Set("status_message", "resumed, waiting to start")
+	if err := app.Dao().SaveRecord(t); err != nil {
+		ErrorLogger.Printf("%v could not save resumed status: %v\n", t.Id, err.Error())
+		return errors.New("could not resume transcode")
+	}
+	jobQueue.notify()
+	InfoLogger.Printf("%v transcode resumed\n", t.Id)
+
+	return nil
+}
+
+// errTranscodePaused is the cause of a transcode stopped by a pause rather than a cancel
+var errTranscodePaused = errors.New("transcode paused")
+
+// pause stops the transcode without removing its files, segments in flight are aborted and sent again when resumed
+func (f *FfmpegTranscode) pause() {
+	f.stop(errTranscodePaused)
+}
+
+// paused is true when the transcode stopped for a pause, a cancel first keeps it cancelled
+func (f *FfmpegTranscode) paused() bool {
+	return errors.Is(context.Cause(f.ctx), errTranscodePaused)
+}
+
+// waitStopped waits for StartTranscode to return, false if it is still stopping after a while
+func (f *FfmpegTranscode) waitStopped() bool {
+	select {
+	case <-f.done:
+		return true
+	case <-time.After(30 * time.Second):
+		return false
+	}
+}
+
+func (f *FfmpegTranscode) transcodeCancelled(req *models.Record) {
+	if f.paused() {
+		f.transcodePaused(req)
+		return
+	}
+	req.Set("status", "cancelled")
+	req.Set("status_message", "cancelled by user")
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v failed to save status update  error: %v\n", req.Id, err.Error())
+	}
+	f.cleanupFiles()
+	InfoLogger.Printf("%v transcode stopped, files removed\n", req.Id)
+}
+
+// transcodePaused leaves a transcode stopped by a pause with its files to resume from, a status saved
+// while it was stopping is put back to paused
+func (f *FfmpegTranscode) transcodePaused(req *models.Record) {
+	saved, err := f.pApp.Dao().FindRecordById("transcodes", req.Id)
+	if err != nil {
+		ErrorLogger.Printf("%v could not get status after pausing: %v\n", req.Id, err.Error())
+		return
+	}
+	switch saved.GetString("status") {
+	case "cancelled":
+		f.cleanupFiles()
+		InfoLogger.Printf("%v transcode stopped, files removed\n", req.Id)
+		return
+	case "paused":
+	default:
+		saved.Set("status", "paused")
+		saved.Set("status_message", "paused by user")
+		if err := f.pApp.Dao().SaveRecord(saved); err != nil {
+			ErrorLogger.Printf("%v failed to save status update  error: %v\n", req.Id, err.Error())
+		}
+	}
+	InfoLogger.Printf("%v transcode stopped, paused until resumed\n", req.Id)
+}
+
+// cleanupFiles removes the segment, rendition and output files of the transcode, the input file is kept.
+// Every file of the transcode is named by its id, files of other transcodes of the same upload are not touched.
+func (f *FfmpegTranscode) cleanupFiles() {
+	files, _ := filepath.Glob(f.WorkDir + "/" + f.RequestId + "_*")
+	for _, file := range files {
+		os.Remove(file)
+	}
+	os.Remove(f.WorkDir + "/" + f.RequestId + ".csv")
+	os.RemoveAll(f.WorkDir + "/" + f.RequestId)
+}
+
+// runFfmpeg runs the ffmpeg command, the command is stopped if the transcode is cancelled
+func (f *FfmpegTranscode) runFfmpeg(stream *ffmpeg.Stream) error {
+	stream.Context = f.ctx
+	return stream.OverWriteOutput().ErrorToStdOut().Run()
+}
+
+// sleepCtx waits for d, returns false if ctx is done first
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
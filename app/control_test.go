@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+// setTestStatus saves the status like a control request that landed before the transcode started running
+func setTestStatus(t *testing.T, f *FfmpegTranscode, status string) {
+	t.Helper()
+	record, err := f.pApp.Dao().FindRecordById("transcodes", f.RequestId)
+	if err != nil {
+		t.Fatalf("could not find transcode: %v", err)
+	}
+	record.Set("status", status)
+	if err := f.pApp.Dao().SaveRecord(record); err != nil {
+		t.Fatalf("could not save status: %v", err)
+	}
+}
+
+func findTestStatus(t *testing.T, f *FfmpegTranscode) string {
+	t.Helper()
+	record, err := f.pApp.Dao().FindRecordById("transcodes", f.RequestId)
+	if err != nil {
+		t.Fatalf("could not find transcode: %v", err)
+	}
+	return record.GetString("status")
+}
+
+func TestStartTranscodeCancelledBeforeRunning(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	setTestStatus(t, f, "cancelled")
+
+	f.StartTranscode()
+
+	if status := findTestStatus(t, f); status != "cancelled" {
+		t.Errorf("status %v after start, want cancelled", status)
+	}
+	if _, running := runningTranscodes.Load(f.RequestId); running {
+		t.Error("cancelled transcode still running")
+	}
+}
+
+func TestPauseGivesBackSegmentSlot(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	other, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	queue := jobQueue
+	t.Cleanup(func() { jobQueue = queue })
+	jobQueue = NewJobQueue(app, 1)
+
+	//the transcode is paused while waiting for the only slot
+	if !jobQueue.acquireSegment(other) {
+		t.Fatal("could not acquire slot")
+	}
+	done := make(chan bool, 1)
+	go func() { done <- jobQueue.acquireSegment(f) }()
+	time.Sleep(50 * time.Millisecond)
+	f.pause()
+
+	select {
+	case ok := <-done:
+		if ok {
+			t.Error("paused transcode acquired a slot")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("paused transcode still waiting for a slot")
+	}
+	jobQueue.releaseSegment()
+	jobQueue.mu.Lock()
+	inFlight, waiting := jobQueue.inFlight, len(jobQueue.waiters)
+	jobQueue.mu.Unlock()
+	if inFlight != 0 || waiting != 0 {
+		t.Errorf("%v segments in flight and %v waiting after pause, want 0", inFlight, waiting)
+	}
+}
+
+func TestPauseStopsAndResumeQueues(t *testing.T) {
+	app := newTestApp(t)
+	f, record := newTestTranscode(t, app, fakeTranscodeReq)
+	useTestFakeBroadcaster(t, f, &FakeBroadcaster{Latency: time.Minute})
+	addTestSegments(t, f, 3)
+	setTestStatus(t, f, "in_progress")
+
+	//run the segments like StartTranscode so the pause stops the transcode
+	runningTranscodes.Store(f.RequestId, f)
+	go func() {
+		defer close(f.done)
+		defer runningTranscodes.CompareAndDelete(f.RequestId, f)
+		if err := f.transcodeSegments(); err != nil {
+			f.transcodeFailed(record, err)
+		}
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := pauseTranscode(app, record); err != nil {
+		t.Fatalf("pauseTranscode: %v", err)
+	}
+	if !f.waitStopped() {
+		t.Fatal("paused transcode did not stop")
+	}
+	if status := findTestStatus(t, f); status != "paused" {
+		t.Errorf("status %v after pause, want paused", status)
+	}
+	for _, seg := range findTestSegments(t, f) {
+		if _, err := os.Stat(seg.GetString("segfile")); err != nil {
+			t.Errorf("segment %v file removed by pause: %v", seg.GetString("num"), err)
+		}
+	}
+
+	saved, _ := app.Dao().FindRecordById("transcodes", f.RequestId)
+	if err := resumeTranscode(app, saved); err != nil {
+		t.Fatalf("resumeTranscode: %v", err)
+	}
+	if status := findTestStatus(t, f); status != "queued" {
+		t.Errorf("status %v after resume, want queued", status)
+	}
+}
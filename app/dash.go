@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+type dashMPD struct {
+	XMLName                   xml.Name   `xml:"MPD"`
+	Xmlns                     string     `xml:"xmlns,attr"`
+	Profiles                  string     `xml:"profiles,attr"`
+	Type                      string     `xml:"type,attr"`
+	MediaPresentationDuration string     `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string     `xml:"minBufferTime,attr"`
+	Period                    dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	ID            string            `xml:"id,attr"`
+	Start         string            `xml:"start,attr"`
+	AdaptationSet dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+type dashAdaptationSet struct {
+	ID               int                  `xml:"id,attr"`
+	ContentType      string               `xml:"contentType,attr"`
+	MimeType         string               `xml:"mimeType,attr"`
+	SegmentAlignment bool                 `xml:"segmentAlignment,attr"`
+	StartWithSAP     int                  `xml:"startWithSAP,attr"`
+	SegmentTemplate  dashSegmentTemplate  `xml:"SegmentTemplate"`
+	Representations  []dashRepresentation `xml:"Representation"`
+}
+
+type dashSegmentTemplate struct {
+	Timescale      int             `xml:"timescale,attr"`
+	Initialization string          `xml:"initialization,attr"`
+	Media          string          `xml:"media,attr"`
+	StartNumber    int             `xml:"startNumber,attr"`
+	Timeline       []dashTimelineS `xml:"SegmentTimeline>S"`
+}
+
+type dashTimelineS struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+}
+
+type dashRepresentation struct {
+	ID        string `xml:"id,attr"`
+	Bandwidth int    `xml:"bandwidth,attr"`
+	Width     int    `xml:"width,attr"`
+	Height    int    `xml:"height,attr"`
+	FrameRate string `xml:"frameRate,attr,omitempty"`
+	Codecs    string `xml:"codecs,attr,omitempty"`
+}
+
+// writeDASH packages the transcoded segments as fragmented mp4 and writes an mpd with one representation per profile
+func (f *FfmpegTranscode) writeDASH(out TranscodeOutput) (string, error) {
+	segments, parts, err := f.renditionParts()
+	if err != nil {
+		return "", err
+	}
+	dir, err := f.outputDir(out)
+	if err != nil {
+		return "", err
+	}
+
+	//segment timeline from the segmenter timings, in milliseconds
+	var timeline []dashTimelineS
+	totalDur := float64(0)
+	maxDur := float64(0)
+	for _, seg := range segments {
+		dur := seg.GetFloat("end") - seg.GetFloat("start")
+		timeline = append(timeline, dashTimelineS{T: int64(math.Round(seg.GetFloat("start") * 1000)), D: int64(math.Round(dur * 1000))})
+		totalDur += dur
+		maxDur = math.Max(maxDur, dur)
+	}
+
+	adaptationSet := dashAdaptationSet{
+		ContentType:      "video",
+		MimeType:         "video/mp4",
+		SegmentAlignment: true,
+		StartWithSAP:     1,
+		SegmentTemplate: dashSegmentTemplate{
+			Timescale:      1000,
+			Initialization: "$RepresentationID$/init.mp4",
+			Media:          "$RepresentationID$/$Number$.m4s",
+			Timeline:       timeline,
+		},
+	}
+	for _, p := range f.Request.Profiles {
+		name := safeName(p.Name)
+		if err := os.MkdirAll(dir+"/"+name, 0755); err != nil {
+			return "", errors.New(fmt.Sprintf("could not create dash folder for rendition %v", p.Name))
+		}
+
+		codecs := ""
+		for i, part := range parts[p.Name] {
+			fragFile := fmt.Sprintf("%v/%v/%d.m4s", dir, name, i)
+			c, err := f.fragmentPart(part, fragFile, dir+"/"+name+"/init.mp4", segments[i].GetFloat("start"), i == 0)
+			if err != nil {
+				return "", errors.New(fmt.Sprintf("could not package segment %v of rendition %v: %v", segments[i].GetString("num"), p.Name, err.Error()))
+			}
+			if i == 0 {
+				codecs = c
+			}
+		}
+
+		rep := dashRepresentation{
+			ID:        name,
+			Bandwidth: profileBandwidth(p, parts[p.Name], totalDur),
+			Width:     p.Width,
+			Height:    p.Height,
+			Codecs:    codecs,
+		}
+		if p.FPS > 0 {
+			rep.FrameRate = fmt.Sprintf("%d/%d", p.FPS, max(p.FPSDen, 1))
+		}
+		adaptationSet.Representations = append(adaptationSet.Representations, rep)
+	}
+
+	mpd := dashMPD{
+		Xmlns:                     "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:                  "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:                      "static",
+		MediaPresentationDuration: fmt.Sprintf("PT%.3fS", totalDur),
+		MinBufferTime:             fmt.Sprintf("PT%dS", int(math.Ceil(maxDur))),
+		Period:                    dashPeriod{ID: "0", Start: "PT0S", AdaptationSet: adaptationSet},
+	}
+	data, err := xml.MarshalIndent(mpd, "", "  ")
+	if err != nil {
+		return "", errors.New("could not create dash manifest")
+	}
+	if err := os.WriteFile(dir+"/manifest.mpd", append([]byte(xml.Header), data...), 0644); err != nil {
+		return "", errors.New("could not write dash manifest")
+	}
+
+	return dir, nil
+}
+
+// fragmentPart remuxes a transcoded part to fragmented mp4 and splits it into the init and media segment,
+// the init segment is only written for the first part since all parts of a rendition share the same encoding
+func (f *FfmpegTranscode) fragmentPart(part string, fragFile string, initFile string, start float64, writeInit bool) (string, error) {
+	tmpFile := fragFile + ".mp4"
+	defer os.Remove(tmpFile)
+	err := f.runFfmpeg(ffmpeg.Input(part).Output(tmpFile, ffmpeg.KwArgs{"c": "copy", "f": "mp4", "movflags": "frag_keyframe+empty_moov+default_base_moof", "output_ts_offset": fmt.Sprintf("%.3f", start)}))
+	if err != nil {
+		return "", err
+	}
+
+	data, err := os.ReadFile(tmpFile)
+	if err != nil {
+		return "", err
+	}
+	initSeg, mediaSeg, err := splitFragmentedMP4(data)
+	if err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(fragFile, mediaSeg, 0644); err != nil {
+		return "", err
+	}
+	if !writeInit {
+		return "", nil
+	}
+	if err := os.WriteFile(initFile, initSeg, 0644); err != nil {
+		return "", err
+	}
+
+	return probeCodecs(tmpFile), nil
+}
+
+// splitFragmentedMP4 returns the boxes before the first moof as the init segment and the rest as the media segment
+func splitFragmentedMP4(data []byte) ([]byte, []byte, error) {
+	pos := 0
+	for pos+8 <= len(data) {
+		size := int(binary.BigEndian.Uint32(data[pos : pos+4]))
+		boxType := string(data[pos+4 : pos+8])
+		if boxType == "moof" || boxType == "styp" || boxType == "sidx" {
+			return data[:pos], data[pos:], nil
+		}
+		switch size {
+		case 0:
+			size = len(data) - pos
+		case 1:
+			if pos+16 > len(data) {
+				return nil, nil, errors.New("invalid mp4 box size")
+			}
+			size = int(binary.BigEndian.Uint64(data[pos+8 : pos+16]))
+		}
+		if size < 8 {
+			return nil, nil, errors.New("invalid mp4 box size")
+		}
+		pos += size
+	}
+
+	return nil, nil, errors.New("no fragments found in mp4")
+}
+
+// probeCodecs returns the RFC 6381 codecs string of the file, empty if not known
+func probeCodecs(file string) string {
+	data, err := ffmpeg.Probe(file)
+	if err != nil {
+		return ""
+	}
+	var info struct {
+		Streams []struct {
+			CodecName string `json:"codec_name"`
+			Profile   string `json:"profile"`
+			Level     int    `json:"level"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return ""
+	}
+
+	var codecs []string
+	for _, s := range info.Streams {
+		switch s.CodecName {
+		case "h264":
+			profileIdc, constraints := 0x64, 0x00
+			switch s.Profile {
+			case "Baseline":
+				profileIdc = 0x42
+			case "Constrained Baseline":
+				profileIdc, constraints = 0x42, 0xe0
+			case "Main":
+				profileIdc = 0x4d
+			}
+			codecs = append(codecs, fmt.Sprintf("avc1.%02x%02x%02x", profileIdc, constraints, s.Level))
+		case "hevc":
+			codecs = append(codecs, "hvc1.1.6.L93.B0")
+		case "aac":
+			codecs = append(codecs, "mp4a.40.2")
+		case "mp3":
+			codecs = append(codecs, "mp4a.40.34")
+		}
+	}
+
+	return strings.Join(codecs, ",")
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/google/uuid"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// downloadInput downloads the s3 or http input, resuming the saved upload of the transcode if it was interrupted
+func (f *FfmpegTranscode) downloadInput(req *models.Record) (*models.Record, error) {
+	var upload *models.Record
+	var err error
+	if uploadId := req.GetString("upload_file"); uploadId != "" {
+		upload, err = f.pApp.Dao().FindRecordById("uploads", uploadId)
+	} else if f.Request.Input.Type == "s3" {
+		upload, err = f.newS3UploadFile()
+	} else {
+		upload, err = f.newHttpUploadFile()
+	}
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("could not create file for upload: %v", err.Error()))
+	}
+	f.setTranscodeUpload(req, upload)
+
+	if upload.GetBool("complete") {
+		f.UploadFile = upload.GetString("localfile")
+		return upload, nil
+	}
+	if f.Request.Input.Type == "s3" {
+		err = f.downloadVideo(upload)
+	} else {
+		err = f.downloadHttpVideo(upload)
+	}
+
+	return upload, err
+}
+
+// newHttpUploadFile registers an uploads record for a file downloaded from an http(s) url
+func (f *FfmpegTranscode) newHttpUploadFile() (*models.Record, error) {
+	if err := checkInputUrl(f.Request.Input.Path); err != nil {
+		return nil, err
+	}
+	u, _ := url.ParseRequestURI(f.Request.Input.Path)
+	collection, err := f.pApp.Dao().FindCollectionByNameOrId("uploads")
+	if err != nil {
+		return nil, err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("user", f.User.Id)
+	record.Set("localfile", f.pApp.DataDir()+"/videos/uploads/"+uuid.NewString()+path.Ext(u.Path))
+	record.Set("filename", f.Request.Input.Path)
+	record.Set("complete", false)
+	if err := f.pApp.Dao().SaveRecord(record); err != nil {
+		ErrorLogger.Printf("could not save upload file %v\n", err.Error())
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// downloadHttpVideo streams the url to the upload file, resuming with range requests if the download is interrupted
+func (f *FfmpegTranscode) downloadHttpVideo(upload *models.Record) error {
+	localFile := upload.GetString("localfile")
+
+	var dErr error
+	for attempt := 1; attempt <= 5; attempt++ {
+		dErr = downloadRange(f.ctx, f.Request.Input.Path, localFile)
+		if dErr == nil {
+			break
+		}
+		ErrorLogger.Printf("%v download attempt %v failed: %v\n", f.RequestId, attempt, dErr.Error())
+		if !sleepCtx(f.ctx, time.Duration(attempt*5)*time.Second) {
+			break
+		}
+	}
+	if dErr != nil {
+		return errors.New(fmt.Sprintf("failed to download video: %v", dErr.Error()))
+	}
+
+	if f.Request.Input.Checksum != "" {
+		if err := verifyChecksum(localFile, f.Request.Input.Checksum); err != nil {
+			os.Remove(localFile)
+			return err
+		}
+	}
+
+	return f.completeDownload(upload)
+}
+
+// completeDownload detects the file type of the downloaded file and marks the upload complete
+func (f *FfmpegTranscode) completeDownload(upload *models.Record) error {
+	localFile := upload.GetString("localfile")
+	fileType, err := mimetype.DetectFile(localFile)
+	if err != nil {
+		return errors.New("could not detect file type of downloaded file")
+	}
+	if !strings.HasPrefix(fileType.String(), "video") {
+		os.Remove(localFile)
+		return errors.New("file is not video, make sure file is video")
+	}
+	if path.Ext(localFile) != fileType.Extension() {
+		typedFile := strings.TrimSuffix(localFile, path.Ext(localFile)) + fileType.Extension()
+		if err := os.Rename(localFile, typedFile); err != nil {
+			return errors.New("could not rename downloaded file")
+		}
+		localFile = typedFile
+	}
+
+	upload.Set("localfile", localFile)
+	upload.Set("filetype", fileType.String())
+	upload.Set("complete", true)
+	if err := f.pApp.Dao().SaveRecord(upload); err != nil {
+		ErrorLogger.Printf("could not save upload file %v\n", err.Error())
+		return err
+	}
+	f.UploadFile = localFile
+
+	return nil
+}
+
+// downloadRange appends the rest of the remote file to the local file, starting from the local file size
+func downloadRange(ctx context.Context, fileUrl string, localFile string) error {
+	file, err := os.OpenFile(localFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.New("could not create local file")
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 6*time.Hour)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := downloadClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	total := int64(-1)
+	switch resp.StatusCode {
+	case http.StatusOK:
+		//server does not support ranges, start over
+		if err := file.Truncate(0); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		total = resp.ContentLength
+	case http.StatusPartialContent:
+		total = rangeTotal(resp.Header.Get("Content-Range"))
+	case http.StatusRequestedRangeNotSatisfiable:
+		//local file already has all the data
+		if rangeTotal(resp.Header.Get("Content-Range")) == offset {
+			return nil
+		}
+		file.Truncate(0)
+		return errors.New("local file larger than remote file")
+	default:
+		return errors.New(fmt.Sprintf("download returned status %v", resp.StatusCode))
+	}
+
+	written, err := io.Copy(file, resp.Body)
+	if err != nil {
+		return err
+	}
+	if total >= 0 {
+		size, _ := file.Seek(0, io.SeekCurrent)
+		if size != total {
+			return errors.New(fmt.Sprintf("download incomplete, %v of %v bytes", size, total))
+		}
+	}
+	InfoLogger.Printf("downloaded %v bytes from %v\n", written, fileUrl)
+
+	return nil
+}
+
+// allowHttpInputs allows inputs downloaded without tls, set from the command line flags at start
+var allowHttpInputs = false
+
+// downloadClient downloads http inputs. Users choose the url, so connections to loopback, private and link-local
+// addresses are refused after the host is resolved, and every redirect is checked like the input url.
+var downloadClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+			Control:   publicAddressOnly,
+		}).DialContext,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ResponseHeaderTimeout: time.Minute,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return checkInputUrl(req.URL.String())
+	},
+}
+
+// checkInputUrl returns an error if the input url is not https, or http when allowed
+func checkInputUrl(fileUrl string) error {
+	u, err := url.ParseRequestURI(fileUrl)
+	if err != nil || u.Host == "" {
+		return errors.New("input path is not a valid http(s) url")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if allowHttpInputs {
+			return nil
+		}
+		return errors.New("input url must be https")
+	}
+
+	return errors.New("input path is not a valid http(s) url")
+}
+
+// publicAddressOnly refuses connections to addresses of this machine and its networks
+func publicAddressOnly(network string, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return errors.New(fmt.Sprintf("download from address %v not allowed", host))
+	}
+
+	return nil
+}
+
+// rangeTotal returns the complete length from a Content-Range header (bytes 0-99/100), -1 if not known
+func rangeTotal(contentRange string) int64 {
+	idx := strings.LastIndex(contentRange, "/")
+	if idx < 0 {
+		return -1
+	}
+	total, err := strconv.ParseInt(contentRange[idx+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+
+	return total
+}
+
+// verifyChecksum checks the file against a checksum like sha256:<hex>, md5 and sha1 are also accepted
+func verifyChecksum(file string, checksum string) error {
+	algo, expected, found := strings.Cut(checksum, ":")
+	if !found {
+		algo, expected = "sha256", checksum
+	}
+	var h hash.Hash
+	switch strings.ToLower(algo) {
+	case "sha256":
+		h = sha256.New()
+	case "sha1":
+		h = sha1.New()
+	case "md5":
+		h = md5.New()
+	default:
+		return errors.New(fmt.Sprintf("checksum type %v not supported", algo))
+	}
+
+	fr, err := os.Open(file)
+	if err != nil {
+		return errors.New("could not open file for checksum")
+	}
+	defer fr.Close()
+	if _, err := io.Copy(h, fr); err != nil {
+		return errors.New("could not read file for checksum")
+	}
+	if !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), expected) {
+		return errors.New("checksum of downloaded file does not match")
+	}
+
+	return nil
+}
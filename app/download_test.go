@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCheckInputUrl(t *testing.T) {
+	allowed := allowHttpInputs
+	t.Cleanup(func() { allowHttpInputs = allowed })
+
+	allowHttpInputs = false
+	if err := checkInputUrl("https://videos.example.com/in.mp4"); err != nil {
+		t.Errorf("https url rejected: %v", err)
+	}
+	for _, u := range []string{"http://videos.example.com/in.mp4", "file:///etc/passwd", "ftp://videos.example.com/in.mp4", "https://", "in.mp4"} {
+		if err := checkInputUrl(u); err == nil {
+			t.Errorf("%v accepted, want error", u)
+		}
+	}
+
+	allowHttpInputs = true
+	if err := checkInputUrl("http://videos.example.com/in.mp4"); err != nil {
+		t.Errorf("http url rejected with http inputs allowed: %v", err)
+	}
+}
+
+func TestDownloadRefusesLocalAddresses(t *testing.T) {
+	allowed := allowHttpInputs
+	t.Cleanup(func() { allowHttpInputs = allowed })
+	allowHttpInputs = true
+
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte("internal"))
+	}))
+	defer srv.Close()
+
+	err := downloadRange(context.Background(), srv.URL+"/in.mp4", t.TempDir()+"/in")
+	if err == nil || !strings.Contains(err.Error(), "not allowed") {
+		t.Errorf("got %v, want the loopback address refused", err)
+	}
+	if requests != 0 {
+		t.Errorf("server got %v requests, want none", requests)
+	}
+
+	//redirects are checked like the input url
+	allowHttpInputs = false
+	req, _ := http.NewRequest("GET", "http://videos.example.com/in.mp4", nil)
+	if err := downloadClient.CheckRedirect(req, []*http.Request{{}}); err == nil {
+		t.Error("redirect to http accepted, want error")
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fakeBroadcasterHost is the host of the fake broadcaster, requests to it never leave the process
+const fakeBroadcasterHost = "fake-broadcaster.local"
+
+// FakeBroadcaster answers segment requests like a Livepeer broadcaster, so the segment pipeline can run offline.
+// Each profile in the transcode configuration gets a rendition holding the segment as sent.
+type FakeBroadcaster struct {
+	//time taken to answer each segment
+	Latency time.Duration
+	//fraction of segments answered with ErrorStatus, 0-1
+	ErrorRate   float64
+	ErrorStatus int
+	//Retry-After seconds sent with 503 errors, none if 0
+	RetryAfter int
+}
+
+func (fb *FakeBroadcaster) broadcaster() *Broadcaster {
+	u, _ := url.Parse("http://" + fakeBroadcasterHost + "/live")
+	return &Broadcaster{Url: u, Weight: 1}
+}
+
+func (fb *FakeBroadcaster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	//health probes
+	if r.Method == "GET" {
+		w.WriteHeader(200)
+		return
+	}
+
+	//POST /live/<manifest>/<n>.<ext>
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if r.Method != "POST" || len(parts) != 3 || parts[0] != "live" {
+		http.Error(w, "not found", 404)
+		return
+	}
+	ext := path.Ext(parts[2])
+	num := strings.TrimSuffix(parts[2], ext)
+	if _, err := strconv.Atoi(num); err != nil {
+		http.Error(w, "invalid segment number", 400)
+		return
+	}
+
+	var config struct {
+		ManifestID string    `json:"manifestID"`
+		Profiles   []Profile `json:"profiles"`
+	}
+	if err := json.Unmarshal([]byte(r.Header.Get("Livepeer-Transcode-Configuration")), &config); err != nil || len(config.Profiles) == 0 {
+		http.Error(w, "invalid Livepeer-Transcode-Configuration", 400)
+		return
+	}
+	data, err := io.ReadAll(r.Body)
+	if err != nil || len(data) == 0 {
+		http.Error(w, "no segment data", 400)
+		return
+	}
+
+	select {
+	case <-time.After(fb.Latency):
+	case <-r.Context().Done():
+		return
+	}
+	if fb.ErrorRate > 0 && rand.Float64() < fb.ErrorRate {
+		if fb.ErrorStatus == http.StatusServiceUnavailable && fb.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(fb.RetryAfter))
+		}
+		http.Error(w, "fake broadcaster error", fb.ErrorStatus)
+		return
+	}
+
+	mw := multipart.NewWriter(w)
+	w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+	w.WriteHeader(200)
+	for _, p := range config.Profiles {
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Type", "video/mp2t")
+		h.Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%v_%v%v"`, p.Name, num, ext))
+		h.Set("Rendition-Name", p.Name)
+		pw, err := mw.CreatePart(h)
+		if err != nil {
+			return
+		}
+		pw.Write(data)
+	}
+	mw.Close()
+}
+
+// fakeBroadcasterClient serves requests to the fake broadcaster in process and sends the rest over the network
+type fakeBroadcasterClient struct {
+	fake *FakeBroadcaster
+	next BroadcasterClient
+}
+
+func (c *fakeBroadcasterClient) Do(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != fakeBroadcasterHost {
+		return c.next.Do(req)
+	}
+
+	rec := &fakeResponse{header: make(http.Header)}
+	c.fake.ServeHTTP(rec, req)
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %v", rec.status, http.StatusText(rec.status)),
+		StatusCode:    rec.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        rec.header,
+		Body:          io.NopCloser(&rec.body),
+		ContentLength: int64(rec.body.Len()),
+		Request:       req,
+	}, nil
+}
+
+// fakeResponse holds the response of the fake broadcaster until it is returned to the client
+type fakeResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *fakeResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *fakeResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *fakeResponse) Write(p []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(p)
+}
+
+// fakeBroadcaster is added to the broadcaster pool when set
+var fakeBroadcaster *FakeBroadcaster
+
+// useFakeBroadcaster adds the fake broadcaster to the pool and serves its requests in process
+func useFakeBroadcaster(fb *FakeBroadcaster) {
+	fakeBroadcaster = fb
+	broadcasterClient = &fakeBroadcasterClient{fake: fb, next: broadcasterClient}
+	InfoLogger.Printf("using fake broadcaster, latency %v, error rate %v\n", fb.Latency, fb.ErrorRate)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+const fakeTranscodeReq = `{"input":{"type":"video/MP2T","path":"in.ts"},"parallel_transcoding":true,"transcode_mode":"broadcaster",
+	"profiles":[{"name":"360p","width":640,"height":360,"encoder":"h264","bitrate":1000000},{"name":"720p","width":1280,"height":720,"encoder":"h264","bitrate":3000000}]}`
+
+// useTestFakeBroadcaster sends segments to the fake broadcaster only, with fresh broadcaster stats and segment slots
+func useTestFakeBroadcaster(t *testing.T, f *FfmpegTranscode, fb *FakeBroadcaster) *Broadcaster {
+	t.Helper()
+	client, pool, queue, policy := broadcasterClient, broadcasterPool, jobQueue, segmentRetryPolicy
+	t.Cleanup(func() {
+		broadcasterClient, broadcasterPool, jobQueue, segmentRetryPolicy = client, pool, queue, policy
+	})
+
+	b := fb.broadcaster()
+	broadcasterClient = &fakeBroadcasterClient{fake: fb, next: client}
+	broadcasterPool = NewBroadcasterPool()
+	broadcasterPool.set([]*Broadcaster{b})
+	jobQueue = NewJobQueue(f.pApp, 4)
+	segmentRetryPolicy = RetryPolicy{MaxAttempts: 2, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+
+	return b
+}
+
+// addTestSegments writes the segment files to the work dir and saves their segments, returns the data of each segment
+func addTestSegments(t *testing.T, f *FfmpegTranscode, count int) [][]byte {
+	t.Helper()
+	collection, err := f.pApp.Dao().FindCollectionByNameOrId("segments")
+	if err != nil {
+		t.Fatalf("could not find segments collection: %v", err)
+	}
+
+	var data [][]byte
+	for i := 1; i <= count; i++ {
+		segData := bytes.Repeat([]byte(fmt.Sprintf("segment %v ", i)), 1000)
+		segFile := fmt.Sprintf("%v/%v_%d.ts", f.WorkDir, f.RequestId, i-1)
+		if err := os.WriteFile(segFile, segData, 0644); err != nil {
+			t.Fatal(err)
+		}
+		record := models.NewRecord(collection)
+		record.Set("segfile", segFile)
+		record.Set("start", (i-1)*f.TargetSegDur)
+		record.Set("end", i*f.TargetSegDur)
+		record.Set("failures", 0)
+		record.Set("transcode", f.RequestId)
+		record.Set("status", "queued")
+		record.Set("num", i)
+		if err := f.pApp.Dao().SaveRecord(record); err != nil {
+			t.Fatalf("could not save segment: %v", err)
+		}
+		data = append(data, segData)
+	}
+
+	return data
+}
+
+func findTestSegments(t *testing.T, f *FfmpegTranscode) []*models.Record {
+	t.Helper()
+	segments, err := f.pApp.Dao().FindRecordsByFilter("segments", "transcode = {:tid}", "+num", 0, 0, dbx.Params{"tid": f.RequestId})
+	if err != nil {
+		t.Fatalf("could not find segments: %v", err)
+	}
+	return segments
+}
+
+func findTestAttempts(t *testing.T, f *FfmpegTranscode) []*models.Record {
+	t.Helper()
+	attempts, err := f.pApp.Dao().FindRecordsByFilter("segment_attempts", "transcode = {:tid}", "+started", 0, 0, dbx.Params{"tid": f.RequestId})
+	if err != nil {
+		t.Fatalf("could not find segment attempts: %v", err)
+	}
+	return attempts
+}
+
+func TestFakeBroadcasterTranscodeSegments(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	useTestFakeBroadcaster(t, f, &FakeBroadcaster{Latency: 10 * time.Millisecond})
+	data := addTestSegments(t, f, 3)
+
+	if err := f.transcodeSegments(); err != nil {
+		t.Fatalf("transcodeSegments: %v", err)
+	}
+
+	segments := findTestSegments(t, f)
+	if len(segments) != len(data) {
+		t.Fatalf("got %v segments, want %v", len(segments), len(data))
+	}
+	for i, seg := range segments {
+		if seg.GetString("status") != "complete" || seg.GetInt("attempts") != 1 {
+			t.Errorf("segment %v status %v after %v attempts, want complete after 1", i+1, seg.GetString("status"), seg.GetInt("attempts"))
+		}
+		renditions := make(map[string]string)
+		if err := seg.UnmarshalJSONField("renditions", &renditions); err != nil {
+			t.Fatalf("segment %v renditions: %v", i+1, err)
+		}
+		if len(renditions) != len(f.Request.Profiles) {
+			t.Errorf("segment %v has renditions %v, want one per profile", i+1, renditions)
+		}
+		for _, p := range f.Request.Profiles {
+			part, ok := renditions[p.Name]
+			want := fmt.Sprintf("%v/%v_%v_%d.ts", f.WorkDir, f.RequestId, p.Name, i+1)
+			if !ok || part != want {
+				t.Errorf("segment %v rendition %v is %q, want %q", i+1, p.Name, part, want)
+				continue
+			}
+			partData, err := os.ReadFile(part)
+			if err != nil || !bytes.Equal(partData, data[i]) {
+				t.Errorf("segment %v rendition %v does not hold the segment sent (err %v)", i+1, p.Name, err)
+			}
+		}
+	}
+
+	attempts := findTestAttempts(t, f)
+	if len(attempts) != len(data) {
+		t.Fatalf("got %v attempts, want %v", len(attempts), len(data))
+	}
+	for _, a := range attempts {
+		if a.GetInt("http_status") != 200 || a.GetString("error") != "" || a.GetInt("bytes_sent") != len(data[0]) {
+			t.Errorf("attempt status %v, error %q, %v bytes sent, want 200 with %v bytes", a.GetInt("http_status"), a.GetString("error"), a.GetInt("bytes_sent"), len(data[0]))
+		}
+	}
+}
+
+func TestFakeBroadcasterErrorRate(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	useTestFakeBroadcaster(t, f, &FakeBroadcaster{ErrorRate: 1, ErrorStatus: 500})
+	addTestSegments(t, f, 1)
+
+	//failed segments are left for the transcode to reconcile
+	if err := f.transcodeSegments(); err != nil {
+		t.Fatalf("transcodeSegments: %v", err)
+	}
+
+	seg := findTestSegments(t, f)[0]
+	if seg.GetString("status") != "error" || !strings.HasPrefix(seg.GetString("status_message"), "failed after 2 attempts") {
+		t.Errorf("segment status %v %q, want error after 2 attempts", seg.GetString("status"), seg.GetString("status_message"))
+	}
+	//each try fails on the only broadcaster then finds no other broadcaster to send to
+	attempts := findTestAttempts(t, f)
+	if len(attempts) != 4 {
+		t.Fatalf("got %v attempts, want 4", len(attempts))
+	}
+	classes := make(map[string]int)
+	for _, a := range attempts {
+		classes[a.GetString("error_class")]++
+		switch a.GetString("error_class") {
+		case "http":
+			if a.GetInt("http_status") != 500 || a.GetString("broadcaster") == "" {
+				t.Errorf("http attempt status %v to %q, want 500 from the broadcaster", a.GetInt("http_status"), a.GetString("broadcaster"))
+			}
+		case "no_broadcaster":
+			if a.GetString("broadcaster") != "" || a.GetInt("bytes_sent") != 0 {
+				t.Errorf("no broadcaster attempt to %q with %v bytes sent, want none", a.GetString("broadcaster"), a.GetInt("bytes_sent"))
+			}
+		}
+	}
+	if classes["http"] != 2 || classes["no_broadcaster"] != 2 {
+		t.Errorf("attempt classes %v, want 2 http and 2 no_broadcaster", classes)
+	}
+}
+
+func TestNoBroadcasterAttempt(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	useTestFakeBroadcaster(t, f, &FakeBroadcaster{})
+	broadcasterPool.set(nil)
+	addTestSegments(t, f, 1)
+	seg := findTestSegments(t, f)[0]
+
+	if err := f.sendTranscode(seg); !errors.Is(err, errNoBroadcaster) {
+		t.Errorf("got %v, want no broadcaster", err)
+	}
+	attempts := findTestAttempts(t, f)
+	if len(attempts) != 1 || attempts[0].GetString("broadcaster") != "" || attempts[0].GetString("error_class") != "no_broadcaster" {
+		t.Errorf("attempts %v, want one no_broadcaster attempt", len(attempts))
+	}
+}
+
+func TestFakeBroadcasterRetryAfter(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	b := useTestFakeBroadcaster(t, f, &FakeBroadcaster{ErrorRate: 1, ErrorStatus: 503, RetryAfter: 30})
+	addTestSegments(t, f, 1)
+	seg := findTestSegments(t, f)[0]
+
+	done := make(chan error, 1)
+	go func() { done <- f.sendTranscode(seg) }()
+
+	//the busy broadcaster frees its slot and holds segments until the Retry-After time
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		broadcasterPool.mu.Lock()
+		s := broadcasterPool.get(b)
+		outstanding, retryAt := s.outstanding, s.retryAt
+		broadcasterPool.mu.Unlock()
+		if !retryAt.IsZero() {
+			if outstanding != 0 {
+				t.Errorf("busy broadcaster has %v segments outstanding, want 0", outstanding)
+			}
+			if until := time.Until(retryAt); until < 25*time.Second || until > 30*time.Second {
+				t.Errorf("broadcaster held for %v, want the 30s Retry-After", until)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("broadcaster was not held after a 503")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	f.cancel()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("segment transcoded by a busy broadcaster")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("segment still waiting for the busy broadcaster after cancel")
+	}
+
+	attempts := findTestAttempts(t, f)
+	if len(attempts) != 1 || attempts[0].GetInt("http_status") != 503 || attempts[0].GetString("error_class") != "busy" {
+		t.Errorf("attempts %v, want one busy 503 attempt", len(attempts))
+	}
+}
+
+func TestFakeBroadcasterBusyError(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	b := useTestFakeBroadcaster(t, f, &FakeBroadcaster{ErrorRate: 1, ErrorStatus: 503, RetryAfter: 7})
+	addTestSegments(t, f, 1)
+	seg := findTestSegments(t, f)[0]
+
+	segF, err := os.Open(seg.GetString("segfile"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer segF.Close()
+	info, _ := segF.Stat()
+	config, _ := f.createTranscodeConfig()
+
+	_, err = f.postSegment(b, seg, segF, info.Size(), config, time.Second, &segmentAttempt{})
+	var busyErr *broadcasterBusyError
+	if !errors.As(err, &busyErr) || busyErr.retryAfter != 7*time.Second {
+		t.Errorf("got error %v, want busy with 7s Retry-After", err)
+	}
+}
+
+func TestFakeBroadcasterLatencyCancel(t *testing.T) {
+	app := newTestApp(t)
+	f, _ := newTestTranscode(t, app, fakeTranscodeReq)
+	b := useTestFakeBroadcaster(t, f, &FakeBroadcaster{Latency: time.Minute})
+	addTestSegments(t, f, 3)
+
+	done := make(chan error, 1)
+	go func() { done <- f.transcodeSegments() }()
+	time.Sleep(100 * time.Millisecond)
+	f.cancel()
+
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "transcode cancelled" {
+			t.Errorf("got %v, want transcode cancelled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("transcode still waiting on the slow broadcaster after cancel")
+	}
+
+	for _, seg := range findTestSegments(t, f) {
+		if seg.GetString("status") == "complete" {
+			t.Errorf("segment %v complete after cancel", seg.GetString("num"))
+		}
+	}
+	broadcasterPool.mu.Lock()
+	outstanding := broadcasterPool.get(b).outstanding
+	broadcasterPool.mu.Unlock()
+	jobQueue.mu.Lock()
+	inFlight := jobQueue.inFlight
+	jobQueue.mu.Unlock()
+	if outstanding != 0 || inFlight != 0 {
+		t.Errorf("%v segments outstanding on the broadcaster and %v in flight after cancel, want 0", outstanding, inFlight)
+	}
+}
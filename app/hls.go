@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// writeHLS writes a master playlist and a media playlist for each rendition from the transcoded segments
+func (f *FfmpegTranscode) writeHLS(out TranscodeOutput) (string, error) {
+	segments, parts, err := f.renditionParts()
+	if err != nil {
+		return "", err
+	}
+	dir, err := f.outputDir(out)
+	if err != nil {
+		return "", err
+	}
+
+	//segment durations from the segmenter timings
+	durations := make([]float64, len(segments))
+	targetDur := float64(0)
+	totalDur := float64(0)
+	for i, seg := range segments {
+		durations[i] = seg.GetFloat("end") - seg.GetFloat("start")
+		targetDur = math.Max(targetDur, durations[i])
+		totalDur += durations[i]
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	for _, p := range f.Request.Profiles {
+		name := safeName(p.Name)
+		if err := os.MkdirAll(dir+"/"+name, 0755); err != nil {
+			return "", errors.New(fmt.Sprintf("could not create hls folder for rendition %v", p.Name))
+		}
+
+		var media strings.Builder
+		media.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+		media.WriteString(fmt.Sprintf("#EXT-X-TARGETDURATION:%d\n", int(math.Ceil(targetDur))))
+		media.WriteString("#EXT-X-MEDIA-SEQUENCE:0\n#EXT-X-PLAYLIST-TYPE:VOD\n")
+		for i, part := range parts[p.Name] {
+			segName := fmt.Sprintf("%d%v", i, path.Ext(part))
+			if err := linkOrCopy(part, dir+"/"+name+"/"+segName); err != nil {
+				return "", errors.New(fmt.Sprintf("could not add segment %v to hls rendition %v", segments[i].GetString("num"), p.Name))
+			}
+			media.WriteString(fmt.Sprintf("#EXTINF:%.3f,\n%v\n", durations[i], segName))
+		}
+		media.WriteString("#EXT-X-ENDLIST\n")
+		if err := os.WriteFile(dir+"/"+name+"/index.m3u8", []byte(media.String()), 0644); err != nil {
+			return "", errors.New(fmt.Sprintf("could not write hls playlist for rendition %v", p.Name))
+		}
+
+		streamInf := fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%dx%d", profileBandwidth(p, parts[p.Name], totalDur), p.Width, p.Height)
+		if p.FPS > 0 {
+			streamInf += fmt.Sprintf(",FRAME-RATE=%.3f", float64(p.FPS)/float64(max(p.FPSDen, 1)))
+		}
+		//same codecs as the dash output, probed from the first part of the rendition
+		if len(parts[p.Name]) > 0 {
+			if codecs := probeCodecs(parts[p.Name][0]); codecs != "" {
+				streamInf += fmt.Sprintf(",CODECS=\"%v\"", codecs)
+			}
+		}
+		master.WriteString(streamInf + "\n" + name + "/index.m3u8\n")
+	}
+
+	if err := os.WriteFile(dir+"/master.m3u8", []byte(master.String()), 0644); err != nil {
+		return "", errors.New("could not write hls master playlist")
+	}
+
+	return dir, nil
+}
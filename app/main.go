@@ -1,13 +1,11 @@
 package main
 
 import (
-	"bufio"
 	b64 "encoding/base64"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
-	"net/url"
 	"os"
 	"path"
 	"strings"
@@ -22,6 +20,7 @@ import (
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/forms"
 	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tokens"
 	"github.com/pocketbase/pocketbase/tools/cron"
@@ -54,6 +53,8 @@ func main() {
 
 	setupRoutes(app)
 
+	setupBroadcasters(app)
+
 	setupTasks(app)
 
 	if err := app.Start(); err != nil {
@@ -62,10 +63,59 @@ func main() {
 }
 
 func setupTasks(app *pocketbase.PocketBase) {
+	var queueInterval, jobWorkers, maxSegments int
+	app.RootCmd.PersistentFlags().IntVar(&queueInterval, "queueInterval", 1, "minutes between checks for queued transcodes to start (1-59)")
+	app.RootCmd.PersistentFlags().IntVar(&jobWorkers, "jobWorkers", 2, "number of transcodes run at one time")
+	app.RootCmd.PersistentFlags().IntVar(&maxSegments, "maxSegments", 10, "number of segments sent to broadcasters at one time across all transcodes")
+	var retryBaseDelay, retryMaxDelay int
+	app.RootCmd.PersistentFlags().BoolVar(&allowHttpInputs, "allowHttpInputs", false, "allow http inputs to be downloaded without tls")
+	app.RootCmd.PersistentFlags().StringVar(&defaultTranscodeMode, "transcodeMode", defaultTranscodeMode, "transcode segments with broadcaster, local (ffmpeg on this machine) or fallback (local when broadcasters fail)")
+	app.RootCmd.PersistentFlags().IntVar(&segmentRetryPolicy.MaxAttempts, "segmentAttempts", segmentRetryPolicy.MaxAttempts, "times a segment is tried before the transcode fails")
+	app.RootCmd.PersistentFlags().IntVar(&retryBaseDelay, "retryBaseDelay", int(segmentRetryPolicy.BaseDelay.Seconds()), "seconds to wait before trying a segment again, doubles each attempt")
+	app.RootCmd.PersistentFlags().IntVar(&retryMaxDelay, "retryMaxDelay", int(segmentRetryPolicy.MaxDelay.Seconds()), "most seconds to wait before trying a segment again")
+
 	c := cron.New()
-	//try and start transcodes that are in queded state
-	c.Add("start_transcodes", "0/1 * 0 ? * * *", func() {
-		checkTranscodeRequests(app)
+	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
+		if queueInterval < 1 || queueInterval > 59 {
+			return fmt.Errorf("queueInterval must be between 1 and 59 minutes, got %v", queueInterval)
+		}
+		if jobWorkers < 1 || maxSegments < 1 {
+			return fmt.Errorf("jobWorkers and maxSegments must be at least 1")
+		}
+		if segmentRetryPolicy.MaxAttempts < 1 || retryBaseDelay < 0 || retryMaxDelay < retryBaseDelay {
+			return fmt.Errorf("segmentAttempts must be at least 1 and retryMaxDelay at least retryBaseDelay")
+		}
+		if err := validTranscodeMode(defaultTranscodeMode); err != nil {
+			return err
+		}
+		segmentRetryPolicy.BaseDelay = time.Duration(retryBaseDelay) * time.Second
+		segmentRetryPolicy.MaxDelay = time.Duration(retryMaxDelay) * time.Second
+		if err := requeueInterruptedTranscodes(app); err != nil {
+			ErrorLogger.Printf("could not queue interrupted transcodes: %v\n", err.Error())
+		}
+		jobQueue = NewJobQueue(app, maxSegments)
+		jobQueue.Start(jobWorkers)
+		//wake the job workers in case a queued transcode was missed
+		err := c.Add("start_transcodes", fmt.Sprintf("*/%d * * * *", queueInterval), func() {
+			checkTranscodeRequests(app)
+		})
+		if err != nil {
+			return err
+		}
+		//probe broadcasters so unhealthy ones are taken out before segments are sent to them
+		err = c.Add("probe_broadcasters", "* * * * *", func() {
+			broadcasterPool.probe()
+		})
+		if err != nil {
+			return err
+		}
+		c.Start()
+		InfoLogger.Printf("checking for queued transcodes every %v minutes\n", queueInterval)
+		return nil
+	})
+	app.OnTerminate().Add(func(e *core.TerminateEvent) error {
+		c.Stop()
+		return nil
 	})
 }
 
@@ -80,13 +130,30 @@ func setupRoutes(app *pocketbase.PocketBase) {
 			InfoLogger.Printf("Upload %s finished\n", event.Upload.ID)
 			//get upload record and mark complete
 			uploadFile, err := app.Dao().FindRecordsByFilter("uploads", "localfile ~ {:uploadId}", "", 1, 0, dbx.Params{"uploadId": event.Upload.ID})
-			if err != nil {
-				ErrorLogger.Printf("error finding upload: %v\n", err.Error())
+			if err != nil || len(uploadFile) == 0 {
+				ErrorLogger.Printf("error finding upload: %v\n", event.Upload.ID)
 				continue
 			}
+			uploadWaitMu.Lock()
 			uploadFile[0].Set("complete", true)
 			app.Dao().SaveRecord(uploadFile[0])
-
+			//queue transcodes waiting on the upload to start
+			waiting, err := app.Dao().FindRecordsByFilter("transcodes", "upload_file = {:uploadId} && status = 'queued'", "+created", 0, 0, dbx.Params{"uploadId": uploadFile[0].Id})
+			if err == nil {
+				for _, t := range waiting {
+					InfoLogger.Printf("%v upload complete, transcode waiting to start\n", t.Id)
+					t.Set("status_message", "upload complete, waiting to start")
+					if err := app.Dao().SaveRecord(t); err != nil {
+						ErrorLogger.Printf("%v could not queue transcode: %v\n", t.Id, err.Error())
+					}
+				}
+			}
+			uploadWaitMu.Unlock()
+			if err != nil {
+				ErrorLogger.Printf("error finding transcodes waiting on upload: %v\n", err.Error())
+				continue
+			}
+			jobQueue.notify()
 		}
 	}()
 
@@ -243,68 +310,133 @@ func setupRoutes(app *pocketbase.PocketBase) {
 			if user == nil {
 				return c.JSON(400, map[string]string{"message": "invalid user, auth token required"})
 			}
-			//load broadcasters
-			bUrls, bErr := getBroadcasters(app.DataDir())
-			if bErr != nil {
-				return apis.NewApiError(500, "could not get broadcaster urls", nil)
-			}
-
 			data, dErr := io.ReadAll(c.Request().Body)
 			if dErr != nil {
 				ErrorLogger.Printf("could not start transcode, request data not valid: %v\n", err.Error())
 				return apis.NewApiError(500, "could not start transcode", nil)
 			}
 			transcodeReq := string(data)
-			t, err := NewFfmpegTranscode(app.DataDir()+"/videos/segments", transcodeReq, bUrls, user, app)
+			t, err := NewFfmpegTranscode(app.DataDir()+"/videos/segments", transcodeReq, user, app)
 			if err != nil {
 				ErrorLogger.Printf("could not start transcode: %v\n", err.Error())
 				return apis.NewApiError(500, "could not start transcode", nil)
 			}
-			go t.StartTranscode() //transcoding in separate thread, this confirms requested successfully
-			return c.JSON(200, map[string]string{"message": "transcode requested"})
+			if err := t.probeSubmittedInput(); err != nil {
+				return apis.NewBadRequestError("input rejected: "+err.Error(), nil)
+			}
+			//save the request, a job worker starts the transcode when one is free
+			tRecord, err := t.saveTranscodeReq()
+			if err != nil {
+				ErrorLogger.Printf("could not queue transcode: %v\n", err.Error())
+				return apis.NewApiError(500, "could not start transcode", nil)
+			}
+			position := queuePosition(app, tRecord)
+			jobQueue.notify()
+			return c.JSON(200, map[string]any{"message": "transcode requested", "id": tRecord.Id, "queuePosition": position})
 		})
 
-		return nil //return no error on BeforeServe
-	})
-}
-
-func getBroadcasters(workDir string) ([]*Broadcaster, error) {
-	var bUrls []*Broadcaster
-	//process seg list
-	rf, err := os.Open(workDir + "/broadcasters.list")
-	if err != nil {
-		rf.Close()
-		return nil, err
-	}
+		//broadcaster management, admins only
+		admin := e.Router.Group("/broadcasters", apis.RequireAdminAuth())
+		admin.GET("", func(c echo.Context) error {
+			records, err := app.Dao().FindRecordsByFilter("broadcasters", "id != ''", "+created", 0, 0)
+			if err != nil {
+				return apis.NewApiError(500, "could not get broadcasters", nil)
+			}
+			broadcasters := make([]map[string]any, 0, len(records))
+			for _, r := range records {
+				broadcasters = append(broadcasters, broadcasterView(r))
+			}
+			return c.JSON(200, broadcasters)
+		})
+		admin.POST("", func(c echo.Context) error {
+			collection, err := app.Dao().FindCollectionByNameOrId("broadcasters")
+			if err != nil {
+				return apis.NewApiError(500, "could not get broadcasters", nil)
+			}
+			record := models.NewRecord(collection)
+			record.Set("weight", 1)
+			record.Set("enabled", true)
+			return saveBroadcaster(app, c, record)
+		})
+		admin.PATCH("/:id", func(c echo.Context) error {
+			record, err := app.Dao().FindRecordById("broadcasters", c.PathParam("id"))
+			if err != nil {
+				return apis.NewNotFoundError("broadcaster not found", nil)
+			}
+			return saveBroadcaster(app, c, record)
+		})
+		admin.DELETE("/:id", func(c echo.Context) error {
+			record, err := app.Dao().FindRecordById("broadcasters", c.PathParam("id"))
+			if err != nil {
+				return apis.NewNotFoundError("broadcaster not found", nil)
+			}
+			if err := app.Dao().DeleteRecord(record); err != nil {
+				return apis.NewBadRequestError("could not delete broadcaster", err)
+			}
+			return c.NoContent(204)
+		})
 
-	fs := bufio.NewReader(rf)
-	curLine := 0
-	for {
-		line, _, err := fs.ReadLine()
-		if err != nil {
-			break
-		}
+		e.Router.POST("/transcode/:id/cancel", func(c echo.Context) error {
+			t, err := findUserTranscode(app, c)
+			if err != nil {
+				return err
+			}
+			if err := cancelTranscode(app, t); err != nil {
+				return apis.NewBadRequestError(err.Error(), nil)
+			}
+			return c.JSON(200, map[string]string{"message": "transcode cancelled"})
+		})
 
-		if len(line) > 0 {
-			bUrlSplit := strings.Split(string(line), "|")
-			u, bErr := url.ParseRequestURI(bUrlSplit[0])
-			if bErr != nil {
-				ErrorLogger.Printf("broadcaster list - could not parse url: %v", line)
-				continue
-			} else {
+		e.Router.POST("/transcode/:id/pause", func(c echo.Context) error {
+			t, err := findUserTranscode(app, c)
+			if err != nil {
+				return err
+			}
+			if err := pauseTranscode(app, t); err != nil {
+				return apis.NewBadRequestError(err.Error(), nil)
+			}
+			return c.JSON(200, map[string]string{"message": "transcode paused"})
+		})
 
+		e.Router.POST("/transcode/:id/resume", func(c echo.Context) error {
+			t, err := findUserTranscode(app, c)
+			if err != nil {
+				return err
 			}
-			if len(bUrlSplit) > 2 {
-				bUrls = append(bUrls, &Broadcaster{Url: u, User: bUrlSplit[1], Password: bUrlSplit[2]})
+			if err := resumeTranscode(app, t); err != nil {
+				return apis.NewBadRequestError(err.Error(), nil)
 			}
+			return c.JSON(200, map[string]string{"message": "transcode resumed"})
+		})
 
-		}
+		return nil //return no error on BeforeServe
+	})
+}
 
-		curLine++
+// saveBroadcaster validates and saves the request fields to the broadcaster record
+func saveBroadcaster(app *pocketbase.PocketBase, c echo.Context, record *models.Record) error {
+	form := forms.NewRecordUpsert(app, record)
+	if err := form.LoadRequest(c.Request(), ""); err != nil {
+		return apis.NewBadRequestError("could not read broadcaster", err)
+	}
+	if err := form.Submit(); err != nil {
+		return apis.NewBadRequestError("could not save broadcaster", err)
+	}
+	return c.JSON(200, broadcasterView(record))
+}
+
+// findUserTranscode returns the transcode in the :id path param if it belongs to the authenticated user
+func findUserTranscode(app *pocketbase.PocketBase, c echo.Context) (*models.Record, error) {
+	user, _ := c.Get(apis.ContextAuthRecordKey).(*models.Record)
+	if user == nil {
+		return nil, apis.NewBadRequestError("invalid user, auth token required", nil)
+	}
+	t, err := app.Dao().FindRecordById("transcodes", c.PathParam("id"))
+	if err != nil || t.GetString("user") != user.Id {
+		return nil, apis.NewNotFoundError("transcode not found", nil)
 	}
 
-	//all urls parsed
-	return bUrls, nil
+	return t, nil
 }
 
 func initTus(app *pocketbase.PocketBase) (*tusd.Handler, error) {
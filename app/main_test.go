@@ -0,0 +1,101 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/migrate"
+)
+
+func TestMain(m *testing.M) {
+	initLogger()
+	os.Exit(m.Run())
+}
+
+// testCollections are the collections and fields the transcode pipeline reads and writes.
+// The pb_migrations are js and need the jsvm plugin, so tests create the collections directly.
+var testCollections = map[string]map[string]string{
+	"uploads": {
+		"filename": schema.FieldTypeText, "localfile": schema.FieldTypeText, "filetype": schema.FieldTypeText,
+		"user": schema.FieldTypeText, "complete": schema.FieldTypeBool,
+	},
+	"transcodes": {
+		"request": schema.FieldTypeJson, "user": schema.FieldTypeText, "status": schema.FieldTypeText,
+		"status_message": schema.FieldTypeText, "upload_file": schema.FieldTypeText, "failures": schema.FieldTypeNumber,
+		"manifest_id": schema.FieldTypeText, "priority": schema.FieldTypeNumber, "renditions": schema.FieldTypeJson,
+		"outputs": schema.FieldTypeJson, "storage_status": schema.FieldTypeJson, "missing": schema.FieldTypeJson,
+		"media": schema.FieldTypeJson,
+	},
+	"segments": {
+		"transcode": schema.FieldTypeText, "segfile": schema.FieldTypeText, "start": schema.FieldTypeNumber,
+		"end": schema.FieldTypeNumber, "failures": schema.FieldTypeNumber, "status_message": schema.FieldTypeText,
+		"status": schema.FieldTypeText, "num": schema.FieldTypeNumber, "renditions": schema.FieldTypeJson,
+		"attempts": schema.FieldTypeNumber, "width": schema.FieldTypeNumber, "height": schema.FieldTypeNumber,
+		"duration": schema.FieldTypeNumber,
+	},
+	"segment_attempts": {
+		"segment": schema.FieldTypeText, "transcode": schema.FieldTypeText, "attempt": schema.FieldTypeNumber,
+		"broadcaster": schema.FieldTypeText, "started": schema.FieldTypeDate, "ended": schema.FieldTypeDate,
+		"http_status": schema.FieldTypeNumber, "bytes_sent": schema.FieldTypeNumber, "bytes_received": schema.FieldTypeNumber,
+		"parts": schema.FieldTypeJson, "error_class": schema.FieldTypeText, "error": schema.FieldTypeText,
+	},
+}
+
+// newTestApp bootstraps an app in a temp data dir with the transcode collections
+func newTestApp(t *testing.T) *pocketbase.PocketBase {
+	t.Helper()
+	app := pocketbase.NewWithConfig(pocketbase.Config{DefaultDataDir: t.TempDir(), HideStartBanner: true})
+	if err := app.Bootstrap(); err != nil {
+		t.Fatalf("could not bootstrap app: %v", err)
+	}
+	t.Cleanup(func() { app.ResetBootstrapState() })
+
+	runner, err := migrate.NewRunner(app.DB(), migrations.AppMigrations)
+	if err != nil {
+		t.Fatalf("could not create migrations runner: %v", err)
+	}
+	if _, err := runner.Up(); err != nil {
+		t.Fatalf("could not run system migrations: %v", err)
+	}
+
+	for name, fields := range testCollections {
+		collection := &models.Collection{Name: name, Type: models.CollectionTypeBase}
+		for field, fieldType := range fields {
+			collection.Schema.AddField(&schema.SchemaField{Name: field, Type: fieldType})
+		}
+		if err := app.Dao().SaveCollection(collection); err != nil {
+			t.Fatalf("could not create %v collection: %v", name, err)
+		}
+	}
+
+	return app
+}
+
+// newTestTranscode saves a transcode record for the request and returns the transcode ready to run
+func newTestTranscode(t *testing.T, app *pocketbase.PocketBase, req string) (*FfmpegTranscode, *models.Record) {
+	t.Helper()
+	users, err := app.Dao().FindCollectionByNameOrId("users")
+	if err != nil {
+		t.Fatalf("could not find users collection: %v", err)
+	}
+	user := models.NewRecord(users)
+	user.SetId("testuser0000001")
+
+	workDir := t.TempDir()
+	f, err := NewFfmpegTranscode(workDir, req, user, app)
+	if err != nil {
+		t.Fatalf("could not create transcode: %v", err)
+	}
+	t.Cleanup(f.cancel)
+	record, err := f.saveTranscodeReq()
+	if err != nil {
+		t.Fatalf("could not save transcode: %v", err)
+	}
+	f.RequestId = record.Id
+
+	return f, record
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/models"
+)
+
+type PackagedOutput struct {
+	Type      string `json:"type"`
+	Path      string `json:"path"`
+	LocalPath string `json:"localPath"`
+}
+
+// packageOutputs builds the requested output types from the transcoded segments
+func (f *FfmpegTranscode) packageOutputs(req *models.Record) error {
+	var packaged []PackagedOutput
+	for _, out := range f.Request.Output {
+		var dir string
+		var err error
+		switch strings.ToLower(out.Type) {
+		case "hls":
+			dir, err = f.writeHLS(out)
+		case "dash":
+			dir, err = f.writeDASH(out)
+		case "", "mp4":
+			//stitched renditions are the mp4 output
+			continue
+		default:
+			err = errors.New(fmt.Sprintf("output type %v not supported", out.Type))
+		}
+		if err != nil {
+			return err
+		}
+		packaged = append(packaged, PackagedOutput{Type: out.Type, Path: out.Path, LocalPath: dir})
+		InfoLogger.Printf("%v %v output written to %v\n", f.RequestId, out.Type, dir)
+	}
+
+	if len(packaged) == 0 {
+		return nil
+	}
+	req.Set("outputs", packaged)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save outputs: %v\n", f.RequestId, err.Error())
+		return errors.New("could not save outputs")
+	}
+
+	return nil
+}
+
+// outputDir creates the local folder for an output, WorkDir/<transcode id>/<output path>
+func (f *FfmpegTranscode) outputDir(out TranscodeOutput) (string, error) {
+	outPath := path.Clean("/" + out.Path)
+	if outPath == "/" {
+		outPath = "/" + strings.ToLower(out.Type)
+	}
+	dir := f.WorkDir + "/" + f.RequestId + outPath
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", errors.New(fmt.Sprintf("could not create %v output folder", out.Type))
+	}
+
+	return dir, nil
+}
+
+// profileBandwidth returns the profile bitrate, estimated from the size of the parts if not set
+func profileBandwidth(p Profile, parts []string, duration float64) int {
+	if p.Bitrate > 0 || duration <= 0 {
+		return p.Bitrate
+	}
+	size := int64(0)
+	for _, part := range parts {
+		if info, err := os.Stat(part); err == nil {
+			size += info.Size()
+		}
+	}
+
+	return int(float64(size*8) / duration)
+}
+
+// linkOrCopy hard links src to dst, copying the file if a link cannot be made
+func linkOrCopy(src string, dst string) error {
+	os.Remove(dst)
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(out, in)
+
+	return err
+}
+
+// safeName strips path separators and parent references from a profile or part name so it can be used in a file path
+func safeName(name string) string {
+	name = strings.ReplaceAll(name, "/", "")
+	return strings.ReplaceAll(name, "..", "")
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/spf13/cast"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// MediaInfo is the probed input, saved on the transcode as media
+type MediaInfo struct {
+	Container   string       `json:"container"`
+	Duration    float64      `json:"duration"`
+	VideoCodec  string       `json:"videoCodec"`
+	Width       int          `json:"width"`
+	Height      int          `json:"height"`
+	FrameRate   float64      `json:"frameRate"`
+	Rotation    int          `json:"rotation"`
+	AudioTracks []AudioTrack `json:"audioTracks"`
+}
+
+type AudioTrack struct {
+	Codec      string `json:"codec"`
+	Channels   int    `json:"channels"`
+	SampleRate int    `json:"sampleRate"`
+	Language   string `json:"language,omitempty"`
+}
+
+// supportedContainers are the ffprobe format names inputs can be segmented from
+var supportedContainers = []string{"mov", "mp4", "mpegts", "matroska", "webm", "flv", "avi"}
+
+// probeInput probes the input file and saves the media info on the transcode,
+// inputs that cannot be transcoded are rejected before segmenting starts
+func (f *FfmpegTranscode) probeInput(req *models.Record) error {
+	info, err := probeMedia(f.UploadFile)
+	if err != nil {
+		return permanent(err)
+	}
+	f.media = info
+
+	req.Set("media", info)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save media info: %v\n", f.RequestId, err.Error())
+	}
+	InfoLogger.Printf("%v input %v %vx%v %.2ffps %.2fs, %v audio tracks\n", f.RequestId, info.VideoCodec, info.Width, info.Height, info.FrameRate, info.Duration, len(info.AudioTracks))
+
+	return nil
+}
+
+// probeSubmittedInput rejects a completed upload that cannot be transcoded when the transcode is submitted,
+// uploads still in progress and s3 and http inputs are probed when the transcode starts
+func (f *FfmpegTranscode) probeSubmittedInput() error {
+	if f.Request.Input.Type == "http" {
+		return checkInputUrl(f.Request.Input.Path)
+	}
+	if f.Request.Input.Type == "s3" {
+		return nil
+	}
+	upload, err := f.findUserUpload()
+	if err != nil || !upload.GetBool("complete") {
+		return nil
+	}
+	_, err = probeMedia(upload.GetString("localfile"))
+
+	return err
+}
+
+// segmentMedia probes the segment for its resolution and exact duration and saves them on the segment,
+// the input resolution and the segment list times are used if the segment cannot be probed
+func (f *FfmpegTranscode) segmentMedia(segment *models.Record) {
+	if segment.GetFloat("duration") > 0 && segment.GetInt("width") > 0 {
+		return
+	}
+
+	width, height := 0, 0
+	duration := segment.GetFloat("end") - segment.GetFloat("start")
+	if f.media != nil {
+		width, height = f.media.Width, f.media.Height
+	}
+	info, err := probeMedia(segment.GetString("segfile"))
+	if err == nil {
+		width, height, duration = info.Width, info.Height, info.Duration
+	} else {
+		ErrorLogger.Printf("%v segment %v could not be probed, using input resolution and segment list duration: %v\n", f.RequestId, segment.GetString("num"), err.Error())
+	}
+
+	segment.Set("width", width)
+	segment.Set("height", height)
+	segment.Set("duration", duration)
+	if err := f.pApp.Dao().SaveRecord(segment); err != nil {
+		ErrorLogger.Printf("%v segment %v could not save media info: %v\n", f.RequestId, segment.GetString("num"), err.Error())
+	}
+}
+
+// probeMedia reads the media info of the file with ffprobe, errors if there is no video or the container is not supported
+func probeMedia(file string) (*MediaInfo, error) {
+	data, err := ffmpeg.Probe(file)
+	if err != nil {
+		return nil, errors.New("input is not a media file ffprobe can read")
+	}
+
+	return parseMediaInfo(data)
+}
+
+// parseMediaInfo reads the ffprobe json output
+func parseMediaInfo(data string) (*MediaInfo, error) {
+	var probe struct {
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType    string            `json:"codec_type"`
+			CodecName    string            `json:"codec_name"`
+			Width        int               `json:"width"`
+			Height       int               `json:"height"`
+			AvgFrameRate string            `json:"avg_frame_rate"`
+			RFrameRate   string            `json:"r_frame_rate"`
+			Channels     int               `json:"channels"`
+			SampleRate   string            `json:"sample_rate"`
+			Duration     string            `json:"duration"`
+			Tags         map[string]string `json:"tags"`
+			Disposition  map[string]int    `json:"disposition"`
+			SideData     []struct {
+				Rotation int `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(data), &probe); err != nil {
+		return nil, errors.New("could not parse input probe data")
+	}
+
+	info := &MediaInfo{Container: probe.Format.FormatName, Duration: cast.ToFloat64(probe.Format.Duration)}
+	if !supportedContainer(info.Container) {
+		return nil, errors.New(fmt.Sprintf("input container %v is not supported, use one of: %v", info.Container, strings.Join(supportedContainers, ", ")))
+	}
+
+	video := false
+	for _, s := range probe.Streams {
+		switch s.CodecType {
+		case "video":
+			//cover art is a video stream of one picture
+			if video || s.Disposition["attached_pic"] == 1 {
+				continue
+			}
+			video = true
+			info.VideoCodec = s.CodecName
+			info.Width = s.Width
+			info.Height = s.Height
+			info.FrameRate = parseFrameRate(s.AvgFrameRate)
+			if info.FrameRate == 0 {
+				info.FrameRate = parseFrameRate(s.RFrameRate)
+			}
+			info.Rotation = cast.ToInt(s.Tags["rotate"])
+			for _, sd := range s.SideData {
+				if sd.Rotation != 0 {
+					info.Rotation = sd.Rotation
+				}
+			}
+			if info.Duration == 0 {
+				info.Duration = cast.ToFloat64(s.Duration)
+			}
+		case "audio":
+			info.AudioTracks = append(info.AudioTracks, AudioTrack{Codec: s.CodecName, Channels: s.Channels, SampleRate: cast.ToInt(s.SampleRate), Language: s.Tags["language"]})
+		}
+	}
+	if !video {
+		return nil, errors.New("input has no video stream")
+	}
+	if info.Width <= 0 || info.Height <= 0 {
+		return nil, errors.New("input video has no resolution")
+	}
+	if info.Duration <= 0 {
+		return nil, errors.New("input has no duration")
+	}
+
+	return info, nil
+}
+
+func supportedContainer(formatName string) bool {
+	//ffprobe lists every name of the demuxer, e.g. mov,mp4,m4a,3gp,3g2,mj2
+	for _, name := range strings.Split(formatName, ",") {
+		for _, c := range supportedContainers {
+			if name == c {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// parseFrameRate reads an ffprobe rate such as 30000/1001
+func parseFrameRate(rate string) float64 {
+	num, den, found := strings.Cut(rate, "/")
+	if !found {
+		return cast.ToFloat64(rate)
+	}
+	d := cast.ToFloat64(den)
+	if d == 0 {
+		return 0
+	}
+
+	return cast.ToFloat64(num) / d
+}
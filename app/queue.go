@@ -0,0 +1,352 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// jobQueue runs the queued transcodes saved in the transcodes collection
+var jobQueue *JobQueue
+
+// priorities accepted on the request, the level is saved on the transcode
+var priorityLevels = map[string]int{"low": 0, "normal": 1, "high": 2}
+
+type JobQueue struct {
+	app     *pocketbase.PocketBase
+	wake    chan struct{}
+	workers int
+
+	//segment slots shared by all transcodes, handed out to users in turns weighted by priority
+	mu          sync.Mutex
+	maxSegments int
+	inFlight    int
+	waiters     []*segmentWaiter
+	pass        map[string]float64
+	vtime       float64
+}
+
+type segmentWaiter struct {
+	f     *FfmpegTranscode
+	ready chan struct{}
+}
+
+// NewJobQueue creates the queue with a cap on segments in flight shared by all transcodes
+func NewJobQueue(app *pocketbase.PocketBase, maxSegments int) *JobQueue {
+	return &JobQueue{
+		app:         app,
+		wake:        make(chan struct{}, 1),
+		maxSegments: maxSegments,
+		pass:        make(map[string]float64),
+	}
+}
+
+// Start runs the job workers, each worker runs one transcode at a time
+func (q *JobQueue) Start(workers int) {
+	q.workers = workers
+	for w := 0; w < workers; w++ {
+		go q.worker()
+	}
+	InfoLogger.Printf("job queue started with %v workers and %v segments in flight\n", workers, q.maxSegments)
+}
+
+// notify wakes an idle worker to check for queued transcodes
+func (q *JobQueue) notify() {
+	if q == nil {
+		return
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *JobQueue) worker() {
+	for {
+		t := q.next()
+		if t == nil {
+			select {
+			case <-q.wake:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		//let another idle worker check for more queued transcodes
+		q.notify()
+
+		f, err := loadSavedTranscode(q.app, t)
+		if err != nil {
+			ErrorLogger.Printf("could not start transcode for %v: %v", t.Id, err.Error())
+			transcodeStatusFailed(q.app, t.Id, err)
+			continue
+		}
+		InfoLogger.Printf("%v starting queued transcode\n", t.Id)
+		f.StartTranscode()
+		q.jobDone(f.User.Id)
+	}
+}
+
+// next claims the queued transcode to run next, nil if there is none.
+// Higher priority transcodes go first, then users with the fewest transcodes running. A user running their
+// share of the workers waits while other users have transcodes queued, whatever the priority.
+func (q *JobQueue) next() *models.Record {
+	//transcodes waiting on an upload are queued again when the upload completes
+	transcodes, err := q.app.Dao().FindRecordsByFilter("transcodes", "status = 'queued' && failures < 10 && status_message != {:waiting}", "-priority,+created", 50, 0, dbx.Params{"waiting": waitingForUploadMsg})
+	if err != nil {
+		ErrorLogger.Printf("could not get queued transcodes: %v", err.Error())
+		return nil
+	}
+
+	running := runningPerUser()
+	for len(transcodes) > 0 {
+		share := q.userShare(running, transcodes)
+		capped := false
+		for _, t := range transcodes {
+			if running[t.GetString("user")] < share {
+				capped = true
+				break
+			}
+		}
+
+		//first of the highest priority with the least running for the user
+		pick := -1
+		for i, t := range transcodes {
+			if pick >= 0 && t.GetInt("priority") < transcodes[pick].GetInt("priority") {
+				break
+			}
+			if capped && running[t.GetString("user")] >= share {
+				continue
+			}
+			if pick < 0 || running[t.GetString("user")] < running[transcodes[pick].GetString("user")] {
+				pick = i
+			}
+		}
+		t := transcodes[pick]
+		transcodes = append(transcodes[:pick], transcodes[pick+1:]...)
+
+		claimed, cErr := claimTranscode(q.app, t.Id)
+		if cErr != nil {
+			ErrorLogger.Printf("%v could not claim transcode: %v\n", t.Id, cErr.Error())
+			continue
+		}
+		if claimed {
+			return t
+		}
+	}
+
+	return nil
+}
+
+// userShare is the workers each user with transcodes running or queued may use, at least one
+func (q *JobQueue) userShare(running map[string]int, queued []*models.Record) int {
+	users := make(map[string]bool)
+	for user := range running {
+		users[user] = true
+	}
+	for _, t := range queued {
+		users[t.GetString("user")] = true
+	}
+	if share := q.workers / len(users); share > 1 {
+		return share
+	}
+
+	return 1
+}
+
+// runningPerUser counts the transcodes running in this process for each user
+func runningPerUser() map[string]int {
+	running := make(map[string]int)
+	runningTranscodes.Range(func(_, v any) bool {
+		running[v.(*FfmpegTranscode).User.Id]++
+		return true
+	})
+
+	return running
+}
+
+// acquireSegment waits for a segment slot, returns false if the transcode is cancelled first
+func (q *JobQueue) acquireSegment(f *FfmpegTranscode) bool {
+	q.mu.Lock()
+	if q.inFlight < q.maxSegments && len(q.waiters) == 0 {
+		q.inFlight++
+		q.charge(f)
+		q.mu.Unlock()
+		return true
+	}
+	w := &segmentWaiter{f: f, ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	q.mu.Unlock()
+
+	select {
+	case <-w.ready:
+		return true
+	case <-f.ctx.Done():
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		for i, qw := range q.waiters {
+			if qw == w {
+				q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+				return false
+			}
+		}
+		//slot was handed over while cancelling, pass it on
+		q.inFlight--
+		q.dispatch()
+		return false
+	}
+}
+
+func (q *JobQueue) releaseSegment() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.inFlight--
+	q.dispatch()
+}
+
+// dispatch hands free slots to the waiting transcode that has had the least share, must hold mu
+func (q *JobQueue) dispatch() {
+	for q.inFlight < q.maxSegments && len(q.waiters) > 0 {
+		pick := 0
+		for i, w := range q.waiters {
+			if q.jobPass(w.f) < q.jobPass(q.waiters[pick].f) {
+				pick = i
+			}
+		}
+		w := q.waiters[pick]
+		q.waiters = append(q.waiters[:pick], q.waiters[pick+1:]...)
+		q.inFlight++
+		q.charge(w.f)
+		close(w.ready)
+	}
+}
+
+// jobPass is the share the user of a transcode has had, so users running many transcodes get no more slots
+// than users running one. Users new to dispatch start at the current share, must hold mu
+func (q *JobQueue) jobPass(f *FfmpegTranscode) float64 {
+	p, ok := q.pass[f.User.Id]
+	if !ok || p < q.vtime {
+		p = q.vtime
+		q.pass[f.User.Id] = p
+	}
+
+	return p
+}
+
+// charge counts a segment against the user of the transcode, higher priority transcodes are charged less so get more turns, must hold mu
+func (q *JobQueue) charge(f *FfmpegTranscode) {
+	p := q.jobPass(f)
+	q.vtime = p
+	q.pass[f.User.Id] = p + 1/float64(int(1)<<f.Priority)
+}
+
+// jobDone forgets the share of a user with no more transcodes running
+func (q *JobQueue) jobDone(user string) {
+	if runningPerUser()[user] > 0 {
+		return
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	delete(q.pass, user)
+}
+
+// priorityLevel returns the level for the request priority, normal if not set
+func priorityLevel(priority string) (int, error) {
+	if priority == "" {
+		return priorityLevels["normal"], nil
+	}
+	level, ok := priorityLevels[priority]
+	if !ok {
+		return 0, errors.New(fmt.Sprintf("priority must be low, normal or high, got %v", priority))
+	}
+
+	return level, nil
+}
+
+// queuePosition returns the position of a queued transcode, 1 is the next transcode to start
+func queuePosition(app *pocketbase.PocketBase, t *models.Record) int {
+	var ahead int
+	err := app.Dao().DB().Select("count(*)").From("transcodes").
+		Where(dbx.NewExp("status = 'queued' AND status_message != {:waiting} AND (priority > {:priority} OR (priority = {:priority} AND created < {:created}))", dbx.Params{"waiting": waitingForUploadMsg, "priority": t.GetInt("priority"), "created": t.GetDateTime("created").String()})).
+		Row(&ahead)
+	if err != nil {
+		ErrorLogger.Printf("%v could not get queue position: %v\n", t.Id, err.Error())
+	}
+
+	return ahead + 1
+}
+
+// loadSavedTranscode creates the transcode from its saved record
+func loadSavedTranscode(app *pocketbase.PocketBase, t *models.Record) (*FfmpegTranscode, error) {
+	user, err := app.Dao().FindRecordById("users", t.GetString("user"))
+	if err != nil {
+		return nil, errors.New("could not find user for transcode")
+	}
+	nt, err := NewFfmpegTranscode(app.DataDir()+"/videos/segments", t.GetString("request"), user, app)
+	if err != nil {
+		return nil, err
+	}
+	nt.RequestId = t.Id
+	nt.Priority = t.GetInt("priority")
+	//keep the manifest id so broadcasters see the same stream when resuming
+	if manifestId := t.GetString("manifest_id"); manifestId != "" {
+		nt.ManifestID = manifestId
+	}
+
+	return nt, nil
+}
+
+// checkTranscodeRequests wakes the job workers to pick up queued transcodes
+func checkTranscodeRequests(app *pocketbase.PocketBase) {
+	jobQueue.notify()
+}
+
+// requeueInterruptedTranscodes moves transcodes left in_progress by a restart back to queued so they are resumed
+func requeueInterruptedTranscodes(app *pocketbase.PocketBase) error {
+	res, err := app.Dao().DB().NewQuery("UPDATE transcodes SET status = 'queued', status_message = 'resuming after restart', updated = {:updated} WHERE status = 'in_progress'").
+		Bind(dbx.Params{"updated": types.NowDateTime().String()}).
+		Execute()
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		InfoLogger.Printf("%v interrupted transcodes queued to resume\n", n)
+	}
+
+	return nil
+}
+
+// claimTranscode moves a queued transcode to in_progress, false if it was already claimed
+func claimTranscode(app *pocketbase.PocketBase, id string) (bool, error) {
+	res, err := app.Dao().DB().NewQuery("UPDATE transcodes SET status = 'in_progress', status_message = 'starting queued transcode', updated = {:updated} WHERE id = {:id} AND status = 'queued'").
+		Bind(dbx.Params{"id": id, "updated": types.NowDateTime().String()}).
+		Execute()
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+// transcodeStatusFailed marks a transcode that could not be started as failed
+func transcodeStatusFailed(app *pocketbase.PocketBase, id string, reqErr error) {
+	req, err := app.Dao().FindRecordById("transcodes", id)
+	if err != nil {
+		return
+	}
+	req.Set("status", "error")
+	req.Set("status_message", reqErr.Error())
+	req.Set("failures", req.GetInt("failures")+1)
+	if err := app.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v trancode could not update status\n", id)
+	}
+}
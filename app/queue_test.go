@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pocketbase/pocketbase"
+)
+
+// newTestUserTranscode saves a queued transcode for the user at the priority level
+func newTestUserTranscode(t *testing.T, app *pocketbase.PocketBase, user string, priority int) *FfmpegTranscode {
+	t.Helper()
+	f, record := newTestTranscode(t, app, fakeTranscodeReq)
+	f.User.SetId(user)
+	f.Priority = priority
+	record.Set("user", user)
+	record.Set("priority", priority)
+	if err := app.Dao().SaveRecord(record); err != nil {
+		t.Fatalf("could not save transcode: %v", err)
+	}
+	return f
+}
+
+func TestNextCapsUserShare(t *testing.T) {
+	app := newTestApp(t)
+	q := NewJobQueue(app, 4)
+	q.workers = 2
+
+	//one user already runs their share of the two workers
+	running := newTestUserTranscode(t, app, "userA0000000001", priorityLevels["normal"])
+	setTestStatus(t, running, "in_progress")
+	runningTranscodes.Store(running.RequestId, running)
+	t.Cleanup(func() { runningTranscodes.Delete(running.RequestId) })
+
+	high := newTestUserTranscode(t, app, "userA0000000001", priorityLevels["high"])
+	time.Sleep(5 * time.Millisecond)
+	low := newTestUserTranscode(t, app, "userB0000000001", priorityLevels["low"])
+
+	if next := q.next(); next == nil || next.Id != low.RequestId {
+		t.Fatalf("claimed %v, want the other user's transcode %v", next, low.RequestId)
+	}
+	//no other user is queued, the user may use the idle worker
+	if next := q.next(); next == nil || next.Id != high.RequestId {
+		t.Fatalf("claimed %v, want %v", next, high.RequestId)
+	}
+}
+
+func TestSegmentShareByUser(t *testing.T) {
+	app := newTestApp(t)
+	q := NewJobQueue(app, 1)
+	a1 := newTestUserTranscode(t, app, "userA0000000001", priorityLevels["normal"])
+	a2 := newTestUserTranscode(t, app, "userA0000000001", priorityLevels["normal"])
+	b := newTestUserTranscode(t, app, "userB0000000001", priorityLevels["normal"])
+
+	if !q.acquireSegment(a1) {
+		t.Fatal("could not acquire slot")
+	}
+	got := make(chan *FfmpegTranscode, 2)
+	for _, f := range []*FfmpegTranscode{a2, b} {
+		go func(f *FfmpegTranscode) {
+			if q.acquireSegment(f) {
+				got <- f
+			}
+		}(f)
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	//the segment of the first transcode counts against the user, the other user goes next
+	q.releaseSegment()
+	select {
+	case f := <-got:
+		if f != b {
+			t.Error("slot went to the user already sending a segment")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("slot not handed over")
+	}
+	q.releaseSegment()
+	<-got
+}
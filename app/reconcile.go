@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// transcodeReport lists what is missing once the segments are transcoded
+type transcodeReport struct {
+	//segments that are not complete
+	Segments []string `json:"segments,omitempty"`
+	//segments missing the rendition of each profile
+	Profiles map[string][]string `json:"profiles,omitempty"`
+}
+
+func (r *transcodeReport) summary() string {
+	var parts []string
+	if len(r.Segments) > 0 {
+		parts = append(parts, fmt.Sprintf("segments not transcoded: %v", strings.Join(r.Segments, ", ")))
+	}
+	profiles := make([]string, 0, len(r.Profiles))
+	for p := range r.Profiles {
+		profiles = append(profiles, p)
+	}
+	sort.Strings(profiles)
+	for _, p := range profiles {
+		parts = append(parts, fmt.Sprintf("rendition %v missing for segments: %v", p, strings.Join(r.Profiles[p], ", ")))
+	}
+
+	return strings.Join(parts, "; ")
+}
+
+// segmentDurationTolerance is the seconds the segments may fall short of the input, e.g. audio longer than the video
+const segmentDurationTolerance = 1.0
+
+// reconcileSegments checks the segments cover the input and every segment is complete and has a rendition file for every profile.
+// Profiles missing from some segments are dropped so the complete profiles are still delivered and the
+// transcode finishes partial. Missing segments, or no complete profile, fail the transcode.
+func (f *FfmpegTranscode) reconcileSegments(req *models.Record) error {
+	segments, sgErr := f.pApp.Dao().FindRecordsByFilter("segments", "transcode = {:tid}", "+num", 0, 0, dbx.Params{"tid": f.RequestId})
+	if sgErr != nil || len(segments) == 0 {
+		return errors.New("could not get segments for transcode")
+	}
+
+	//segments saved from a segmenter that stopped early do not cover the input
+	if f.media != nil && f.media.Duration > 0 {
+		var covered float64
+		for _, seg := range segments {
+			covered += seg.GetFloat("end") - seg.GetFloat("start")
+		}
+		if f.media.Duration-covered > math.Max(segmentDurationTolerance, f.media.Duration/100) {
+			return errors.New(fmt.Sprintf("segments cover %.2fs of the %.2fs input", covered, f.media.Duration))
+		}
+	}
+
+	report := &transcodeReport{Profiles: make(map[string][]string)}
+	for _, seg := range segments {
+		num := seg.GetString("num")
+		if seg.GetString("status") != "complete" {
+			report.Segments = append(report.Segments, num)
+			continue
+		}
+		renditions := make(map[string]string)
+		seg.UnmarshalJSONField("renditions", &renditions)
+		for _, p := range f.Request.Profiles {
+			part, ok := renditions[p.Name]
+			if !ok {
+				report.Profiles[p.Name] = append(report.Profiles[p.Name], num)
+				continue
+			}
+			if info, err := os.Stat(part); err != nil || info.Size() == 0 {
+				report.Profiles[p.Name] = append(report.Profiles[p.Name], num)
+			}
+		}
+	}
+	if len(report.Segments) == 0 && len(report.Profiles) == 0 {
+		//clear a report left by an earlier run, saved with the next status update
+		req.Set("missing", nil)
+		return nil
+	}
+
+	req.Set("missing", report)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save missing renditions: %v\n", f.RequestId, err.Error())
+	}
+	if len(report.Segments) > 0 {
+		return errors.New(report.summary())
+	}
+
+	var complete []Profile
+	for _, p := range f.Request.Profiles {
+		if _, missing := report.Profiles[p.Name]; !missing {
+			complete = append(complete, p)
+		}
+	}
+	if len(complete) == 0 {
+		return errors.New(report.summary())
+	}
+	InfoLogger.Printf("%v continuing with %v of %v profiles, %v\n", f.RequestId, len(complete), len(f.Request.Profiles), report.summary())
+	f.Request.Profiles = complete
+	f.missing = report
+
+	return nil
+}
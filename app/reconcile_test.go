@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+)
+
+// completeTestSegments marks the segments complete with a rendition file for every profile
+func completeTestSegments(t *testing.T, f *FfmpegTranscode) {
+	t.Helper()
+	for _, seg := range findTestSegments(t, f) {
+		renditions := make(map[string]string)
+		for _, p := range f.Request.Profiles {
+			part := fmt.Sprintf("%v/%v_%v_%v.ts", f.WorkDir, f.RequestId, p.Name, seg.GetString("num"))
+			if err := os.WriteFile(part, []byte("rendition"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			renditions[p.Name] = part
+		}
+		seg.Set("renditions", renditions)
+		seg.Set("status", "complete")
+		if err := f.pApp.Dao().SaveRecord(seg); err != nil {
+			t.Fatalf("could not save segment: %v", err)
+		}
+	}
+}
+
+func TestReconcileSegmentsDuration(t *testing.T) {
+	app := newTestApp(t)
+	f, record := newTestTranscode(t, app, fakeTranscodeReq)
+	addTestSegments(t, f, 3)
+	completeTestSegments(t, f)
+
+	//three 10s segments cover the input, a little short of it is allowed
+	f.media = &MediaInfo{Duration: 30.5}
+	if err := f.reconcileSegments(record); err != nil {
+		t.Errorf("reconcileSegments: %v", err)
+	}
+
+	//the segmenter stopped early
+	f.media = &MediaInfo{Duration: 100}
+	err := f.reconcileSegments(record)
+	if err == nil || !strings.Contains(err.Error(), "segments cover 30.00s of the 100.00s input") {
+		t.Errorf("got %v, want the segments short of the input", err)
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how many times a segment is attempted and the wait between attempts
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	//fraction of the delay that is random, 0.2 waits between 80% and 120% of the delay
+	Jitter float64
+}
+
+// segmentRetryPolicy is used for every segment, set from the command line flags at start
+var segmentRetryPolicy = RetryPolicy{MaxAttempts: 5, BaseDelay: 15 * time.Second, MaxDelay: 5 * time.Minute, Jitter: 0.2}
+
+// delay returns the wait after the attempt, doubling each attempt up to the max delay
+func (r RetryPolicy) delay(attempt int) time.Duration {
+	d := r.BaseDelay
+	for i := 1; i < attempt && d < r.MaxDelay; i++ {
+		d *= 2
+	}
+	if d > r.MaxDelay {
+		d = r.MaxDelay
+	}
+	if r.Jitter > 0 {
+		d = time.Duration(float64(d) * (1 - r.Jitter + 2*r.Jitter*rand.Float64()))
+	}
+
+	return d
+}
+
+// retry returns true if the failed attempt should be tried again
+func (r RetryPolicy) retry(attempt int, err error) bool {
+	return attempt < r.MaxAttempts && retryable(err)
+}
+
+// permanentError is an error that fails the same way however many times it is tried, e.g. the segment file is missing
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func permanent(err error) error {
+	return &permanentError{err: err}
+}
+
+func retryable(err error) bool {
+	var pErr *permanentError
+	return !errors.As(err, &pErr)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/spf13/cast"
+	ffmpeg "github.com/u2takey/ffmpeg-go"
+)
+
+// stitchRenditions concatenates the transcoded segments of each profile into one mp4 per profile
+func (f *FfmpegTranscode) stitchRenditions(req *models.Record) error {
+	InfoLogger.Printf(f.RequestId + " stitching renditions")
+
+	_, parts, err := f.renditionParts()
+	if err != nil {
+		return err
+	}
+
+	outputs := make(map[string]string)
+	for _, p := range f.Request.Profiles {
+		out, err := f.concatParts(p.Name, parts[p.Name])
+		if err != nil {
+			return err
+		}
+		if err := verifyRendition(out); err != nil {
+			return errors.New(fmt.Sprintf("rendition %v failed verification: %v", p.Name, err.Error()))
+		}
+		outputs[p.Name] = out
+		InfoLogger.Printf("%v rendition %v stitched to %v\n", f.RequestId, p.Name, out)
+	}
+
+	req.Set("renditions", outputs)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save renditions: %v\n", f.RequestId, err.Error())
+		return errors.New("could not save renditions")
+	}
+
+	return nil
+}
+
+// renditionParts returns the segments ordered by num and the transcoded parts of each profile in the same order
+func (f *FfmpegTranscode) renditionParts() ([]*models.Record, map[string][]string, error) {
+	segments, sgErr := f.pApp.Dao().FindRecordsByFilter("segments", "transcode = {:tid}", "+num", 0, 0, dbx.Params{"tid": f.RequestId})
+	if sgErr != nil || len(segments) == 0 {
+		return nil, nil, errors.New("could not get segments for transcode")
+	}
+
+	//group the parts by profile, ordered by segment num
+	parts := make(map[string][]string)
+	for _, seg := range segments {
+		renditions := make(map[string]string)
+		if err := seg.UnmarshalJSONField("renditions", &renditions); err != nil {
+			return nil, nil, errors.New(fmt.Sprintf("segment %v has no renditions", seg.GetString("num")))
+		}
+		for _, p := range f.Request.Profiles {
+			part, ok := renditions[p.Name]
+			if !ok {
+				return nil, nil, errors.New(fmt.Sprintf("segment %v is missing rendition %v", seg.GetString("num"), p.Name))
+			}
+			parts[p.Name] = append(parts[p.Name], part)
+		}
+	}
+
+	return segments, parts, nil
+}
+
+// concatParts joins the parts with the ffmpeg concat demuxer without re-encoding
+func (f *FfmpegTranscode) concatParts(profile string, parts []string) (string, error) {
+	base := f.WorkDir + "/" + f.RequestId + "_" + safeName(profile)
+
+	var list strings.Builder
+	for _, part := range parts {
+		abs, err := filepath.Abs(part)
+		if err != nil {
+			return "", errors.New(fmt.Sprintf("invalid part file %v", part))
+		}
+		list.WriteString("file '" + strings.ReplaceAll(abs, "'", `'\''`) + "'\n")
+	}
+	listFile := base + "_concat.txt"
+	if err := os.WriteFile(listFile, []byte(list.String()), 0644); err != nil {
+		return "", errors.New(fmt.Sprintf("could not write concat list for rendition %v", profile))
+	}
+	defer os.Remove(listFile)
+
+	out := base + ".mp4"
+	err := f.runFfmpeg(ffmpeg.Input(listFile, ffmpeg.KwArgs{"f": "concat", "safe": "0"}).Output(out, ffmpeg.KwArgs{"c": "copy", "movflags": "+faststart"}))
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("could not stitch rendition %v: %v", profile, err.Error()))
+	}
+
+	return out, nil
+}
+
+// verifyRendition checks the stitched file has a video stream and a duration
+func verifyRendition(file string) error {
+	data, err := ffmpeg.Probe(file)
+	if err != nil {
+		return errors.New("could not probe file")
+	}
+	var info struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal([]byte(data), &info); err != nil {
+		return errors.New("could not parse probe data")
+	}
+	if cast.ToFloat64(info.Format.Duration) <= 0 {
+		return errors.New("file has no duration")
+	}
+	for _, s := range info.Streams {
+		if s.CodecType == "video" {
+			return nil
+		}
+	}
+
+	return errors.New("file has no video stream")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+type StorageObject struct {
+	Key      string `json:"key"`
+	File     string `json:"file"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	Message  string `json:"message,omitempty"`
+	Attempts int    `json:"attempts"`
+}
+
+// newS3Client connects to the endpoint of the input or storage, the endpoint can be a host or a url.
+// a http:// url or secure=false connects without tls (e.g. local minio)
+func newS3Client(loc TranscodeFile) (*minio.Client, error) {
+	endpoint := loc.Endpoint
+	secure := true
+	if strings.Contains(endpoint, "://") {
+		u, err := url.Parse(endpoint)
+		if err != nil || u.Host == "" {
+			return nil, errors.New("failed to parse s3 endpoint url")
+		}
+		endpoint = u.Host
+		secure = u.Scheme != "http"
+	}
+	if loc.Secure != nil {
+		secure = *loc.Secure
+	}
+
+	lookup := minio.BucketLookupAuto
+	switch strings.ToLower(loc.BucketLookup) {
+	case "path":
+		lookup = minio.BucketLookupPath
+	case "dns", "virtual-host":
+		lookup = minio.BucketLookupDNS
+	}
+
+	return minio.New(endpoint, &minio.Options{
+		Creds:        credentials.NewStaticV4(loc.AuthID, loc.AuthPW, ""),
+		Secure:       secure,
+		BucketLookup: lookup,
+	})
+}
+
+// downloadObjectRange appends the rest of the object to the local file, starting from the local file size
+func downloadObjectRange(ctx context.Context, s3Client *minio.Client, loc TranscodeFile, localFile string, size int64) error {
+	file, err := os.OpenFile(localFile, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return errors.New("could not create local file")
+	}
+	defer file.Close()
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset == size {
+		return nil
+	}
+	if offset > size {
+		file.Truncate(0)
+		return errors.New("local file larger than s3 object")
+	}
+
+	opts := minio.GetObjectOptions{}
+	if offset > 0 {
+		if err := opts.SetRange(offset, 0); err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, 6*time.Hour)
+	defer cancel()
+	reader, err := s3Client.GetObject(ctx, loc.Bucket, loc.Path, opts)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	if _, err := io.CopyN(file, reader, size-offset); err != nil {
+		return errors.New("failed copying s3 download to file")
+	}
+
+	return nil
+}
+
+// uploadOutputs uploads the stitched renditions and packaged outputs to the storage bucket,
+// the status of each object is saved on the transcode as it is uploaded
+func (f *FfmpegTranscode) uploadOutputs(req *models.Record) error {
+	s3Client, err := newS3Client(f.Request.Storage)
+	if err != nil {
+		return errors.New("failed to upload outputs: s3 connection failed")
+	}
+
+	objects, err := f.storageObjects(req)
+	if err != nil {
+		return err
+	}
+	f.saveStorageStatus(req, objects)
+
+	failed := 0
+	for i := range objects {
+		obj := &objects[i]
+		obj.Status = "uploading"
+		f.saveStorageStatus(req, objects)
+
+		for obj.Attempts < 3 {
+			obj.Attempts++
+			uErr := f.uploadObject(s3Client, obj)
+			if uErr == nil {
+				obj.Status = "complete"
+				obj.Message = ""
+				break
+			}
+			obj.Status = "error"
+			obj.Message = uErr.Error()
+			ErrorLogger.Printf("%v upload of %v failed (attempt %v): %v\n", f.RequestId, obj.Key, obj.Attempts, uErr.Error())
+			if !sleepCtx(f.ctx, time.Duration(obj.Attempts*5)*time.Second) {
+				break
+			}
+		}
+		if obj.Status != "complete" {
+			failed++
+		}
+		f.saveStorageStatus(req, objects)
+	}
+
+	if failed > 0 {
+		return errors.New(fmt.Sprintf("failed to upload %v of %v outputs", failed, len(objects)))
+	}
+
+	return nil
+}
+
+func (f *FfmpegTranscode) uploadObject(s3Client *minio.Client, obj *StorageObject) error {
+	ctx, cancel := context.WithTimeout(f.ctx, 30*time.Minute)
+	defer cancel()
+
+	//large files are sent as multipart uploads in 16MiB parts
+	_, err := s3Client.FPutObject(ctx, f.Request.Storage.Bucket, obj.Key, obj.File, minio.PutObjectOptions{
+		ContentType: contentTypeFromExt(path.Ext(obj.File)),
+		PartSize:    16 * 1024 * 1024,
+	})
+
+	return err
+}
+
+// storageObjects lists the local files to upload and their keys in the bucket
+func (f *FfmpegTranscode) storageObjects(req *models.Record) ([]StorageObject, error) {
+	var objects []StorageObject
+	addObject := func(file string, key string) {
+		obj := StorageObject{Key: key, File: file, Status: "queued"}
+		if info, err := os.Stat(file); err == nil {
+			obj.Size = info.Size()
+		}
+		objects = append(objects, obj)
+	}
+
+	renditions := make(map[string]string)
+	req.UnmarshalJSONField("renditions", &renditions)
+	for _, file := range renditions {
+		addObject(file, f.storageKey(path.Base(file)))
+	}
+
+	var outputs []PackagedOutput
+	req.UnmarshalJSONField("outputs", &outputs)
+	for _, out := range outputs {
+		outPath := out.Path
+		if outPath == "" {
+			outPath = out.Type
+		}
+		err := filepath.Walk(out.LocalPath, func(file string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(out.LocalPath, file)
+			if err != nil {
+				return err
+			}
+			addObject(file, f.storageKey(path.Join(outPath, filepath.ToSlash(rel))))
+			return nil
+		})
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("could not list %v output files", out.Type))
+		}
+	}
+
+	return objects, nil
+}
+
+func (f *FfmpegTranscode) storageKey(name string) string {
+	return strings.TrimPrefix(path.Join(f.Request.Storage.Path, name), "/")
+}
+
+func contentTypeFromExt(ext string) string {
+	switch ext {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".ts":
+		return "video/MP2T"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".mp4":
+		return "video/mp4"
+	}
+	if ct := mime.TypeByExtension(ext); ct != "" {
+		return ct
+	}
+
+	return "application/octet-stream"
+}
+
+func (f *FfmpegTranscode) saveStorageStatus(req *models.Record, objects []StorageObject) {
+	req.Set("storage_status", objects)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save storage status: %v\n", f.RequestId, err.Error())
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// fakeS3 serves one object over plain http like a local minio, answering HEAD and ranged GET for path and dns style buckets
+type fakeS3 struct {
+	bucket string
+	key    string
+	data   []byte
+
+	mu       sync.Mutex
+	requests []fakeS3Request
+}
+
+type fakeS3Request struct {
+	method string
+	host   string
+	path   string
+	rng    string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if _, ok := r.URL.Query()["location"]; ok {
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/">us-east-1</LocationConstraint>`)
+		return
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, fakeS3Request{method: r.Method, host: r.Host, path: r.URL.Path, rng: r.Header.Get("Range")})
+	s.mu.Unlock()
+
+	//dns style requests have the bucket in the host, path style in the path
+	key := strings.TrimPrefix(r.URL.Path, "/")
+	if !strings.HasPrefix(r.Host, s.bucket+".") {
+		key = strings.TrimPrefix(key, s.bucket+"/")
+	}
+	if key != s.key {
+		w.WriteHeader(404)
+		return
+	}
+
+	start, end := int64(0), int64(len(s.data))-1
+	if rng := r.Header.Get("Range"); rng != "" {
+		bounds := strings.SplitN(strings.TrimPrefix(rng, "bytes="), "-", 2)
+		start, _ = strconv.ParseInt(bounds[0], 10, 64)
+		if bounds[1] != "" {
+			end, _ = strconv.ParseInt(bounds[1], 10, 64)
+		}
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Last-Modified", time.Unix(1700000000, 0).UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", `"fake-etag"`)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.FormatInt(end-start+1, 10))
+	if r.Header.Get("Range") != "" {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(s.data)))
+		w.WriteHeader(206)
+	} else {
+		w.WriteHeader(200)
+	}
+	if r.Method == "GET" {
+		w.Write(s.data[start : end+1])
+	}
+}
+
+func (s *fakeS3) objectRequests() []fakeS3Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]fakeS3Request(nil), s.requests...)
+}
+
+// testMP4 returns mp4 file data, an ftyp box followed by filler
+func testMP4(size int) []byte {
+	data := []byte("\x00\x00\x00\x18ftypisom\x00\x00\x02\x00isomiso2")
+	for i := 0; len(data) < size; i++ {
+		data = append(data, byte(i))
+	}
+	return data
+}
+
+// dialFakeS3 sends every s3 connection to the server, so dns style bucket hosts reach it
+func dialFakeS3(t *testing.T, srv *httptest.Server) {
+	t.Helper()
+	addr := srv.Listener.Addr().String()
+	defaultTransport := minio.DefaultTransport
+	minio.DefaultTransport = func(secure bool) (*http.Transport, error) {
+		tr, err := defaultTransport(secure)
+		if err != nil {
+			return nil, err
+		}
+		tr.Proxy = nil
+		tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return tr, nil
+	}
+	t.Cleanup(func() { minio.DefaultTransport = defaultTransport })
+}
+
+func TestNewS3ClientEndpoint(t *testing.T) {
+	insecure := false
+	secure := true
+	tests := []struct {
+		name   string
+		loc    TranscodeFile
+		scheme string
+		host   string
+	}{
+		{"host defaults to tls", TranscodeFile{Endpoint: "s3.example.com"}, "https", "s3.example.com"},
+		{"https url", TranscodeFile{Endpoint: "https://s3.example.com"}, "https", "s3.example.com"},
+		{"http url", TranscodeFile{Endpoint: "http://localhost:9000"}, "http", "localhost:9000"},
+		{"secure false", TranscodeFile{Endpoint: "localhost:9000", Secure: &insecure}, "http", "localhost:9000"},
+		{"secure overrides url", TranscodeFile{Endpoint: "http://s3.example.com", Secure: &secure}, "https", "s3.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := newS3Client(tt.loc)
+			if err != nil {
+				t.Fatalf("newS3Client: %v", err)
+			}
+			if u := client.EndpointURL(); u.Scheme != tt.scheme || u.Host != tt.host {
+				t.Errorf("endpoint %v, want %v://%v", u, tt.scheme, tt.host)
+			}
+		})
+	}
+
+	if _, err := newS3Client(TranscodeFile{Endpoint: "http://"}); err == nil {
+		t.Error("expected error for url without host")
+	}
+}
+
+func TestDownloadS3Input(t *testing.T) {
+	insecure := false
+	tests := []struct {
+		name         string
+		endpoint     string
+		secure       *bool
+		bucketLookup string
+		wantHost     string
+		wantPath     string
+	}{
+		{"path lookup over http url", "http://minio.test:9000", nil, "path", "minio.test:9000", "/videos/in/clip"},
+		{"path lookup with secure false", "minio.test:9000", &insecure, "path", "minio.test:9000", "/videos/in/clip"},
+		{"dns lookup", "http://minio.test:9000", nil, "dns", "videos.minio.test:9000", "/in/clip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s3 := &fakeS3{bucket: "videos", key: "in/clip", data: testMP4(64 * 1024)}
+			srv := httptest.NewServer(s3)
+			defer srv.Close()
+			dialFakeS3(t, srv)
+
+			app := newTestApp(t)
+			if err := os.MkdirAll(app.DataDir()+"/videos/uploads", 0755); err != nil {
+				t.Fatal(err)
+			}
+			input := TranscodeFile{Type: "s3", Endpoint: tt.endpoint, Secure: tt.secure, BucketLookup: tt.bucketLookup, Bucket: "videos", Path: "in/clip"}
+			f, record := newTestTranscode(t, app, fmt.Sprintf(`{"input":{"type":"s3","endpoint":%q,"bucket":"videos","path":"in/clip","bucketLookup":%q}}`, tt.endpoint, tt.bucketLookup))
+			f.Request.Input = input
+
+			upload, err := f.downloadInput(record)
+			if err != nil {
+				t.Fatalf("downloadInput: %v", err)
+			}
+
+			reqs := s3.objectRequests()
+			if len(reqs) == 0 {
+				t.Fatal("no object requests sent")
+			}
+			for _, r := range reqs {
+				if r.host != tt.wantHost || r.path != tt.wantPath {
+					t.Errorf("%v request to %v%v, want %v%v", r.method, r.host, r.path, tt.wantHost, tt.wantPath)
+				}
+			}
+			checkCompleteDownload(t, f, upload, s3.data)
+		})
+	}
+}
+
+func TestDownloadS3InputResumes(t *testing.T) {
+	s3 := &fakeS3{bucket: "videos", key: "in/clip.bin", data: testMP4(64 * 1024)}
+	srv := httptest.NewServer(s3)
+	defer srv.Close()
+
+	app := newTestApp(t)
+	if err := os.MkdirAll(app.DataDir()+"/videos/uploads", 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, record := newTestTranscode(t, app, fmt.Sprintf(`{"input":{"type":"s3","endpoint":%q,"bucket":"videos","path":"in/clip.bin","bucketLookup":"path"}}`, srv.URL))
+
+	//an interrupted download left part of the object in the upload file
+	upload, err := f.newS3UploadFile()
+	if err != nil {
+		t.Fatalf("newS3UploadFile: %v", err)
+	}
+	partial := 10000
+	if err := os.WriteFile(upload.GetString("localfile"), s3.data[:partial], 0644); err != nil {
+		t.Fatal(err)
+	}
+	f.setTranscodeUpload(record, upload)
+
+	upload, err = f.downloadInput(record)
+	if err != nil {
+		t.Fatalf("downloadInput: %v", err)
+	}
+
+	var gets []fakeS3Request
+	for _, r := range s3.objectRequests() {
+		if r.method == "GET" {
+			gets = append(gets, r)
+		}
+	}
+	if len(gets) != 1 || gets[0].rng != fmt.Sprintf("bytes=%d-", partial) {
+		t.Errorf("GET requests %+v, want one from byte %v", gets, partial)
+	}
+	checkCompleteDownload(t, f, upload, s3.data)
+}
+
+// checkCompleteDownload checks the upload is complete with the detected type and renamed to its extension
+func checkCompleteDownload(t *testing.T, f *FfmpegTranscode, upload *models.Record, want []byte) {
+	t.Helper()
+	saved, err := f.pApp.Dao().FindRecordById("uploads", upload.Id)
+	if err != nil {
+		t.Fatalf("could not find upload: %v", err)
+	}
+	localFile := saved.GetString("localfile")
+	if !saved.GetBool("complete") || saved.GetString("filetype") != "video/mp4" {
+		t.Errorf("upload complete %v type %v, want complete video/mp4", saved.GetBool("complete"), saved.GetString("filetype"))
+	}
+	if !strings.HasSuffix(localFile, ".mp4") || f.UploadFile != localFile {
+		t.Errorf("local file %v, upload file %v, want the same .mp4 file", localFile, f.UploadFile)
+	}
+	data, err := os.ReadFile(localFile)
+	if err != nil || !bytes.Equal(data, want) {
+		t.Errorf("downloaded file does not match the object (err %v)", err)
+	}
+}
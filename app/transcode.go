@@ -2,7 +2,6 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -15,19 +14,19 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/gabriel-vasile/mimetype"
 	"github.com/google/uuid"
 	"github.com/minio/minio-go/v7"
-	"github.com/minio/minio-go/v7/pkg/credentials"
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase"
 	"github.com/pocketbase/pocketbase/daos"
 	"github.com/pocketbase/pocketbase/models"
+	"github.com/spf13/cast"
 	ffmpeg "github.com/u2takey/ffmpeg-go"
 )
 
@@ -38,11 +37,15 @@ type TranscodeFile struct {
 	AuthPW   string `json:"secretAccessKey"`
 	Bucket   string `json:"bucket"`
 	Path     string `json:"path"`
+	Checksum string `json:"checksum,omitempty"`
+	//s3 options, secure defaults to true and bucketLookup to auto (path or dns for virtual-host buckets)
+	Secure       *bool  `json:"secure,omitempty"`
+	BucketLookup string `json:"bucketLookup,omitempty"`
 }
 
 type TranscodeOutput struct {
-	Type string
-	Path string
+	Type string `json:"type"`
+	Path string `json:"path"`
 }
 
 type Profile struct {
@@ -66,12 +69,20 @@ type TranscodeRequest struct {
 	Output              []TranscodeOutput `json:"outputs"`
 	Profiles            []Profile         `json:"profiles"`
 	ParallelTranscoding bool              `json:"parallel_transcoding"`
+	//low, normal or high, defaults to normal
+	Priority string `json:"priority,omitempty"`
+	//broadcaster, local or fallback (local when broadcasters fail), defaults to the transcodeMode setting
+	TranscodeMode string `json:"transcode_mode,omitempty"`
 }
 
 type Broadcaster struct {
 	Url      *url.URL
 	User     string
 	Password string
+	Weight   int
+	Region   string
+	//segments sent at one time
+	MaxInFlight int
 }
 
 type FfmpegTranscode struct {
@@ -79,14 +90,25 @@ type FfmpegTranscode struct {
 	UploadFile   string
 	TargetSegDur int
 	ManifestID   string
-	Broadcasters []*Broadcaster
 	Request      TranscodeRequest
 	RequestId    string
+	Priority     int
 	User         *models.Record
 	pApp         *pocketbase.PocketBase
+	ctx          context.Context
+	cancel       context.CancelFunc
+	//stops the transcode with a cause, e.g. paused
+	stop context.CancelCauseFunc
+	//closed when StartTranscode returns
+	done chan struct{}
+	//set when some profiles could not be transcoded and the rest are delivered
+	missing    *transcodeReport
+	transcoder Transcoder
+	//probed input, set before segmenting
+	media *MediaInfo
 }
 
-func NewFfmpegTranscode(workDir string, req string, broadcasters []*Broadcaster, user *models.Record, app *pocketbase.PocketBase) (*FfmpegTranscode, error) {
+func NewFfmpegTranscode(workDir string, req string, user *models.Record, app *pocketbase.PocketBase) (*FfmpegTranscode, error) {
 	var transcodeReq TranscodeRequest
 	err := json.Unmarshal([]byte(req), &transcodeReq)
 	if err != nil {
@@ -94,60 +116,124 @@ func NewFfmpegTranscode(workDir string, req string, broadcasters []*Broadcaster,
 		ErrorLogger.Println(err.Error())
 		return nil, err
 	}
+	priority, err := priorityLevel(transcodeReq.Priority)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := transcodeMode(transcodeReq.TranscodeMode)
+	if err != nil {
+		return nil, err
+	}
 
-	return &FfmpegTranscode{
+	ctx, stop := context.WithCancelCause(context.Background())
+	f := &FfmpegTranscode{
+		ctx:          ctx,
+		cancel:       func() { stop(nil) },
+		stop:         stop,
+		done:         make(chan struct{}),
 		WorkDir:      workDir,
 		UploadFile:   "",
 		Request:      transcodeReq,
 		ManifestID:   uuid.NewString(),
-		Broadcasters: broadcasters,
+		Priority:     priority,
 		User:         user,
 		pApp:         app,
-		TargetSegDur: 10}, nil
+		TargetSegDur: 10}
+	f.transcoder = newTranscoder(f, mode)
+
+	return f, nil
 }
 
+// runningTranscodes holds the transcodes running in this process by transcode id
+var runningTranscodes sync.Map
+
+// waitingForUploadMsg is the status message of queued transcodes waiting on their upload to complete
+const waitingForUploadMsg = "transcode will start when upload is complete"
+
+// uploadWaitMu serializes checking an upload is complete with the upload complete handler so a
+// transcode waiting on an upload is always queued to start by one or the other
+var uploadWaitMu sync.Mutex
+
 func (f *FfmpegTranscode) StartTranscode() {
-	//save transcode request to db
-	tRecord, tErr := f.saveTranscodeReq()
-	f.RequestId = tRecord.Id
+	var tRecord *models.Record
+	var tErr error
+	if f.RequestId == "" {
+		//save transcode request to db
+		tRecord, tErr = f.saveTranscodeReq()
+	} else {
+		//transcode request already saved, e.g. was waiting for upload
+		tRecord, tErr = f.pApp.Dao().FindRecordById("transcodes", f.RequestId)
+	}
 	if tErr != nil {
 		ErrorLogger.Printf("%v\n", tErr.Error())
-		f.transcodeFailed(tRecord, tErr)
 		return
 	}
-	//get the file if s3
-	if f.Request.Input.Type == "s3" {
-		f.updateTranscodeReqStatus(tRecord, "queued", "downloading s3 file")
+	f.RequestId = tRecord.Id
+	if _, running := runningTranscodes.LoadOrStore(f.RequestId, f); running {
+		InfoLogger.Printf("%v transcode already running\n", f.RequestId)
+		return
+	}
+	defer close(f.done)
+	defer runningTranscodes.CompareAndDelete(f.RequestId, f)
+	defer f.cancel()
 
-		fp, fpErr := f.newS3UploadFile()
-		f.UploadFile = fp
-		if fp != "" {
-			ErrorLogger.Println(fmt.Sprint("could not create file for upload: %w", fpErr))
-			f.transcodeFailed(tRecord, fpErr)
-			return
-		}
-		dErr := f.downloadVideo()
+	//a cancel or pause that landed before the transcode was running only changed the saved status
+	if current, err := f.pApp.Dao().FindRecordById("transcodes", f.RequestId); err == nil {
+		tRecord = current
+	}
+	if tRecord.GetString("status") == "cancelled" {
+		InfoLogger.Printf("%v transcode cancelled before starting\n", f.RequestId)
+		f.cleanupFiles()
+		return
+	}
+	//a paused transcode is queued again when resumed
+	if tRecord.GetString("status") == "paused" {
+		InfoLogger.Printf("%v transcode paused before starting\n", f.RequestId)
+		return
+	}
+
+	//get the file if s3 or http
+	if f.Request.Input.Type == "s3" || f.Request.Input.Type == "http" {
+		f.updateTranscodeReqStatus(tRecord, "in_progress", "downloading "+f.Request.Input.Type+" file")
+
+		upload, dErr := f.downloadInput(tRecord)
 		if dErr != nil {
 			ErrorLogger.Printf("could not download file: %v\n", dErr.Error())
 			f.transcodeFailed(tRecord, dErr)
 			return
 		}
+		f.Request.Input.Type = upload.GetString("filetype")
 	} else {
 		//file uploaded to server for transcoding, get local filename from database and filetype
-		uploadFile, err := f.pApp.Dao().FindRecordsByFilter("uploads", "filename ~ {:filename} && user={:userid}", "", 1, 0, dbx.Params{"filename": f.Request.Input.Path, "userid": f.User.Id})
-		if uploadFile[0].GetBool("complete") == false {
-			//TODO: add to queue
-			InfoLogger.Printf("could not start transcode, file upload not complete")
-			f.updateTranscodeReqStatus(tRecord, "queued", "transcode will start when upload is complete")
-		}
+		uploadWaitMu.Lock()
+		uploadFile, err := f.findUploadFile(tRecord)
 		if err != nil {
+			uploadWaitMu.Unlock()
 			ErrorLogger.Printf("could not start transcode, local file not found  %v\n", err.Error())
 			f.transcodeFailed(tRecord, err)
 			return
 		}
+		tRecord.Set("upload_file", uploadFile.Id)
+		if uploadFile.GetBool("complete") == false {
+			//upload complete handler starts the transcode
+			InfoLogger.Printf("%v file upload not complete, transcode queued until upload completes\n", f.RequestId)
+			f.updateTranscodeReqStatus(tRecord, "queued", waitingForUploadMsg)
+			runningTranscodes.CompareAndDelete(f.RequestId, f)
+			uploadWaitMu.Unlock()
+			return
+		}
+		uploadWaitMu.Unlock()
+
+		f.Request.Input.Type = uploadFile.GetString("filetype")
+		f.UploadFile = uploadFile.GetString("localfile")
+	}
 
-		f.Request.Input.Type = uploadFile[0].GetString("filetype")
-		f.UploadFile = uploadFile[0].GetString("localfile")
+	//reject inputs that cannot be transcoded before segmenting
+	f.updateTranscodeReqStatus(tRecord, "in_progress", "probing input")
+	if pErr := f.probeInput(tRecord); pErr != nil {
+		ErrorLogger.Printf("%v input rejected: %v\n", f.RequestId, pErr.Error())
+		f.transcodeFailed(tRecord, pErr)
+		return
 	}
 
 	if f.Request.ParallelTranscoding {
@@ -159,25 +245,77 @@ func (f *FfmpegTranscode) StartTranscode() {
 			return
 		}
 
-		f.transcodeComplete(tRecord)
-
 	} else {
-		//this would be for transcoding the entire file on one CPU.
+		//transcode the entire file in one request
 		f.updateTranscodeReqStatus(tRecord, "in_progress", "sending file to transcode")
+		err := f.transcodeWholeFile()
+		if err != nil {
+			ErrorLogger.Printf("error transcoding: %v\n", err.Error())
+			f.transcodeFailed(tRecord, err)
+			return
+		}
+	}
 
-		f.transcodeComplete(tRecord)
+	if f.ctx.Err() != nil {
+		f.transcodeCancelled(tRecord)
+		return
 	}
+
+	//check every segment has every rendition before putting them together
+	if rErr := f.reconcileSegments(tRecord); rErr != nil {
+		ErrorLogger.Printf("error transcoding: %v\n", rErr.Error())
+		f.transcodeFailed(tRecord, rErr)
+		return
+	}
+
+	//put the transcoded segments back together, one file per profile
+	f.updateTranscodeReqStatus(tRecord, "in_progress", "stitching renditions")
+	sErr := f.stitchRenditions(tRecord)
+	if sErr != nil {
+		ErrorLogger.Printf("error stitching renditions: %v\n", sErr.Error())
+		f.transcodeFailed(tRecord, sErr)
+		return
+	}
+
+	//build the requested output types (hls etc.)
+	f.updateTranscodeReqStatus(tRecord, "in_progress", "packaging outputs")
+	oErr := f.packageOutputs(tRecord)
+	if oErr != nil {
+		ErrorLogger.Printf("error packaging outputs: %v\n", oErr.Error())
+		f.transcodeFailed(tRecord, oErr)
+		return
+	}
+
+	//send renditions and outputs to the storage target
+	if f.Request.Storage.Type == "s3" {
+		f.updateTranscodeReqStatus(tRecord, "in_progress", "uploading outputs")
+		uErr := f.uploadOutputs(tRecord)
+		if uErr != nil {
+			ErrorLogger.Printf("error uploading outputs: %v\n", uErr.Error())
+			f.transcodeFailed(tRecord, uErr)
+			return
+		}
+	}
+
+	f.transcodeComplete(tRecord)
 }
 
 func (f *FfmpegTranscode) segmentAndTranscodeVideo(segDur int) error {
+	//resume from the saved segments if the transcode was interrupted
+	if f.hasSavedSegments() {
+		InfoLogger.Printf("%v resuming transcode from saved segments\n", f.RequestId)
+		return f.transcodeSegments()
+	}
+
 	inpExt := path.Ext(f.UploadFile)
 	if inpExt == "" {
 		inpExt = extFromFileType(f.Request.Input.Type)
 	}
-	fn := f.WorkDir + "/" + strings.ReplaceAll(path.Base(f.UploadFile), inpExt, "")
-	if fn == "." || fn == "/" {
+	if f.UploadFile == "" {
 		return errors.New("invalid file provided")
 	}
+	//segments are named by the transcode so transcodes of the same upload do not share files
+	fn := f.WorkDir + "/" + f.RequestId
 	seg_list := fn + ".csv"
 	//remove seg list if exists
 	_, err := os.Stat(seg_list)
@@ -190,10 +328,14 @@ func (f *FfmpegTranscode) segmentAndTranscodeVideo(segDur int) error {
 	}
 
 	//segment video on key frames using
-	fpErr := ffmpeg.Input(f.UploadFile, ffmpeg.KwArgs{"f": strings.Replace(inpExt, ".", "", 1)}).Output(fn+"_%d"+inpExt, ffmpeg.KwArgs{"f": "segment", "segment_time": fmt.Sprint(segDur), "min_seg_duration": fmt.Sprint(segDur / 2), "segment_list": seg_list, "segment_list_type": "csv", "reset_timestamps": "0", "c": "copy"}).OverWriteOutput().ErrorToStdOut().Run()
+	fpErr := f.runFfmpeg(ffmpeg.Input(f.UploadFile, ffmpeg.KwArgs{"f": strings.Replace(inpExt, ".", "", 1)}).Output(fn+"_%d"+inpExt, ffmpeg.KwArgs{"f": "segment", "segment_time": fmt.Sprint(segDur), "min_seg_duration": fmt.Sprint(segDur / 2), "segment_list": seg_list, "segment_list_type": "csv", "reset_timestamps": "0", "c": "copy"}))
+	if f.ctx.Err() != nil {
+		return errors.New("transcode cancelled")
+	}
 
 	if fpErr != nil {
-		ErrorLogger.Printf("video segmenter had error:  %v\n", err.Error())
+		ErrorLogger.Printf("video segmenter had error:  %v\n", fpErr.Error())
+		return fpErr
 	}
 
 	//add segments to db for tracking
@@ -206,6 +348,74 @@ func (f *FfmpegTranscode) segmentAndTranscodeVideo(segDur int) error {
 
 }
 
+// hasSavedSegments checks the segments of the transcode are saved and their files exist, segments with
+// missing files are removed so the video is segmented again
+func (f *FfmpegTranscode) hasSavedSegments() bool {
+	segments, err := f.pApp.Dao().FindRecordsByFilter("segments", "transcode = {:tid}", "+num", 0, 0, dbx.Params{"tid": f.RequestId})
+	if err != nil || len(segments) == 0 {
+		return false
+	}
+	for _, seg := range segments {
+		if _, err := os.Stat(seg.GetString("segfile")); err == nil {
+			continue
+		}
+		InfoLogger.Printf("%v segment %v file missing, segmenting video again\n", f.RequestId, seg.GetString("num"))
+		for _, s := range segments {
+			if err := f.pApp.Dao().DeleteRecord(s); err != nil {
+				ErrorLogger.Printf("%v could not delete segment %v: %v\n", f.RequestId, s.GetString("num"), err.Error())
+			}
+		}
+		return false
+	}
+
+	return true
+}
+
+func (f *FfmpegTranscode) transcodeWholeFile() error {
+	InfoLogger.Printf(f.RequestId + " transcoding whole file")
+
+	//resume the saved segment if the transcode was interrupted
+	saved, _ := f.pApp.Dao().FindRecordsByFilter("segments", "transcode = {:tid}", "+num", 1, 0, dbx.Params{"tid": f.RequestId})
+	if len(saved) > 0 {
+		if saved[0].GetString("status") == "complete" {
+			InfoLogger.Printf("%v file already transcoded\n", f.RequestId)
+			return nil
+		}
+		return f.transcodeFileSegment(saved[0])
+	}
+
+	//track the file as one segment so renditions are saved the same way as parallel transcoding
+	segments, scErr := f.pApp.Dao().FindCollectionByNameOrId("segments")
+	if scErr != nil {
+		ErrorLogger.Printf("could not get segments collection: %v\n", scErr)
+		return errors.New("could not create segment record")
+	}
+	record := models.NewRecord(segments)
+	record.Set("segfile", f.UploadFile)
+	record.Set("start", 0)
+	record.Set("end", f.getDuration())
+	record.Set("failures", 0)
+	record.Set("transcode", f.RequestId)
+	record.Set("status", "queued")
+	record.Set("num", 1)
+	if err := f.pApp.Dao().SaveRecord(record); err != nil {
+		ErrorLogger.Printf("error saving segment: %v\n", err.Error())
+		return errors.New("could not create segment record")
+	}
+
+	return f.transcodeFileSegment(record)
+}
+
+// transcodeFileSegment transcodes the whole file segment in a segment slot with the retry policy, like a parallel segment
+func (f *FfmpegTranscode) transcodeFileSegment(seg *models.Record) error {
+	if !jobQueue.acquireSegment(f) {
+		return errors.New("transcode cancelled")
+	}
+	defer jobQueue.releaseSegment()
+
+	return f.transcodeSegment(seg)
+}
+
 func (f *FfmpegTranscode) processSegmentList(seg_list string) error {
 	InfoLogger.Printf(f.RequestId + " processing segment list")
 
@@ -275,62 +485,75 @@ func (f *FfmpegTranscode) transcodeSegments() error {
 		return errors.New("could not get segments for transcode")
 	}
 
-	//transcode up to 5 segments at one time
-	segPace := float64(2)
-	tchan := make(chan int, 5)
+	//segments in flight are limited by the slots shared across all transcodes and the slots of each broadcaster
 	var wg sync.WaitGroup
+	var failedMu sync.Mutex
+	var failed []string
 	InfoLogger.Printf("%v transcoding %v segments\n", f.RequestId, len(segments))
-	for ss := 0; ss < 3; ss++ {
-		//try transcode 3 times
-		for _, seg := range segments {
-			if seg.GetString("status") == "complete" {
-				InfoLogger.Printf("%v skipping segment %v, transcoding complete", seg.GetString("transcode"), seg.GetString("num"))
-				continue
+	for _, seg := range segments {
+		//stop sending segments when cancelled or paused
+		if f.ctx.Err() != nil {
+			break
+		}
+		if seg.GetString("status") == "complete" {
+			InfoLogger.Printf("%v skipping segment %v, transcoding complete", seg.GetString("transcode"), seg.GetString("num"))
+			continue
+		}
+		//wait for a slot and wait for all to complete before exiting
+		if !jobQueue.acquireSegment(f) {
+			continue
+		}
+		wg.Add(1)
+		go func(seg *models.Record) {
+			defer wg.Done()
+			defer jobQueue.releaseSegment()
+			if err := f.transcodeSegment(seg); err != nil && f.ctx.Err() == nil {
+				failedMu.Lock()
+				failed = append(failed, seg.GetString("num"))
+				failedMu.Unlock()
 			}
-			//limit transcodes to channel size and wait for all to complete before exiting
-			wg.Add(1)
-			tchan <- 1
-			go func(seg *models.Record) {
-				//try 5 times to transcode segments
-				maxRetries := 5
-				baseDelay := 15
-				for tt := 1; tt <= maxRetries; tt++ {
-					InfoLogger.Printf("%v segment %v transcode attempt %v", f.RequestId, seg.GetString("num"), seg.GetInt("failures")+1)
-					start := time.Now()
-					err := f.sendTranscode(seg)
-
-					if err == nil {
-						if time.Since(start) <= (15 * time.Second) {
-							segPace--
-						}
-
-						<-tchan
-						break
-					} else {
-						segPace++
-						cd := time.Duration(tt*2*baseDelay) * time.Second
-						InfoLogger.Printf("%v  segment %v did not complete, waiting %v\n", f.RequestId, seg.GetString("num"), cd.Seconds())
-						//wait for cooldown
-						time.Sleep(cd)
-					}
-				}
+		}(seg)
+	}
+	wg.Wait()
 
-				//transcode complete for segment (may be error but tried 5 times)
-				wg.Done()
-				<-tchan
+	if f.ctx.Err() != nil {
+		return errors.New("transcode cancelled")
+	}
+	//failed segments are reported when the transcode is reconciled
+	if len(failed) > 0 {
+		sort.Slice(failed, func(i, j int) bool { return cast.ToInt(failed[i]) < cast.ToInt(failed[j]) })
+		ErrorLogger.Printf("%v %v of %v segments failed after retries: %v\n", f.RequestId, len(failed), len(segments), strings.Join(failed, ", "))
+	}
 
-			}(seg)
+	return nil
+}
 
-			//pace submitting segments
-			p := time.Duration(math.Max(2, segPace)) * time.Second
-			InfoLogger.Printf("sending next segment after %v seconds", p.Seconds())
-			time.Sleep(p)
+// transcodeSegment sends the segment until it is transcoded or the retry policy gives up
+func (f *FfmpegTranscode) transcodeSegment(seg *models.Record) error {
+	num := seg.GetString("num")
+	for attempt := 1; ; attempt++ {
+		InfoLogger.Printf("%v segment %v transcode attempt %v", f.RequestId, num, attempt)
+		err := f.sendTranscode(seg)
+		if err == nil {
+			return nil
+		}
+		if f.ctx.Err() != nil {
+			return err
+		}
+		if !segmentRetryPolicy.retry(attempt, err) {
+			msg := fmt.Sprintf("failed after %v attempts: %v", attempt, err.Error())
+			f.updateSegmentTranscodeStatus(seg, "error", msg)
+			ErrorLogger.Printf("%v segment %v %v\n", f.RequestId, num, msg)
+			return errors.New(msg)
 		}
-	}
-
-	wg.Wait()
 
-	return nil
+		cd := segmentRetryPolicy.delay(attempt)
+		InfoLogger.Printf("%v segment %v did not complete, waiting %v\n", f.RequestId, num, cd.Round(time.Second))
+		//wait for cooldown
+		if !sleepCtx(f.ctx, cd) {
+			return errors.New("transcode cancelled")
+		}
+	}
 }
 
 // CustomReader is a wrapper for the underlying data source with a larger buffer size.
@@ -343,121 +566,313 @@ func (r *CustomReader) Read(p []byte) (n int, err error) {
 	return r.underlyingReader.Read(p)
 }
 
+// sendTranscode transcodes the segment with the transcoder for the request and saves the renditions
 func (f *FfmpegTranscode) sendTranscode(segment *models.Record) error {
 
 	//update segment status
+	segment.Set("attempts", segment.GetInt("attempts")+1)
 	f.updateSegmentTranscodeStatus(segment, "in_progress", "transcoding")
 
+	renditions, err := f.transcoder.Transcode(segment)
+	if err != nil {
+		return f.segmentTranscodeFailed(segment, err)
+	}
+
+	segment.Set("renditions", renditions)
+	f.segmentTranscodeComplete(segment)
+	return nil
+}
+
+// Transcode sends the segment to the broadcasters, each is tried once
+func (t *broadcasterTranscoder) Transcode(segment *models.Record) (map[string]string, error) {
+	f := t.f
 	segFile := segment.GetString("segfile")
-	start := segment.GetFloat("start")
-	end := segment.GetFloat("end")
 	num := segment.GetString("num")
-	segDur := (end - start) * float64(1000)
+	f.segmentMedia(segment)
+	duration := segment.GetFloat("duration")
+	//allow longer requests when sending more than one segment duration (e.g. the whole file)
+	reqTimeout := time.Duration(math.Max(float64(f.TargetSegDur), duration)*20) * time.Second
 	transcodeConfig, tcErr := f.createTranscodeConfig()
 
 	if tcErr != nil {
-		return f.segmentTranscodeFailed(segment, errors.New("failed to parse transcode config"))
+		return nil, permanent(errors.New("failed to parse transcode config"))
 	}
 
 	//test opening file
 	InfoLogger.Printf("%v opening semgent to send: %v\n", f.RequestId, segFile)
 	segF, sfErr := os.Open(segFile)
-	defer segF.Close()
 	if sfErr != nil {
 		ErrorLogger.Printf("%v segment open error %v\n", f.RequestId, sfErr.Error())
-		return f.segmentTranscodeFailed(segment, errors.New("failed to open input file"))
+		return nil, permanent(errors.New("failed to open input file"))
+	}
+	defer segF.Close()
+	segInfo, siErr := segF.Stat()
+	if siErr != nil || segInfo.Size() == 0 {
+		return nil, permanent(errors.New("input file is empty"))
 	}
-	segData, _ := io.ReadAll(segF)
 	InfoLogger.Printf("%v transcoding segment %v", f.RequestId, segFile)
 
-	for _, b := range f.Broadcasters {
-		bUrl := b.Url.String() + "/" + f.ManifestID + "/" + num + path.Ext(segFile)
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(f.TargetSegDur*20)*time.Second)
-		defer cancel()
-		req, _ := http.NewRequestWithContext(ctx, "POST", bUrl, bytes.NewBuffer(segData))
-		if b.User != "" {
-			req.SetBasicAuth(b.User, b.Password)
+	//try each broadcaster once, the pool picks the healthiest with the fewest segments in flight
+	//and holds the segment until a broadcaster has a free slot
+	tried := make(map[*Broadcaster]bool)
+	busy := 0
+	for {
+		b := broadcasterPool.acquire(f.ctx, tried)
+		if b == nil {
+			break
 		}
-		req.Header.Add("Accept", "multipart/mixed")
-		req.Header.Add("Content-Duration", fmt.Sprintf("%d", int(segDur)))
-		req.Header.Add("Content-Resolution", "1920x1080") //TODO: consider getting this. B should start parsing this but it does not go into fee paid
-		req.Header.Add("Livepeer-Transcode-Configuration", transcodeConfig)
-
-		resp, rErr := http.DefaultClient.Do(req)
-		if rErr != nil {
-			ErrorLogger.Printf("%v failed to send request to transcode: %v\n", f.RequestId, rErr.Error())
+
+		attempt := &segmentAttempt{broadcaster: b.Url.String(), started: time.Now()}
+		renditions, err := f.postSegment(b, segment, segF, segInfo.Size(), transcodeConfig, reqTimeout, attempt)
+		attempt.ended = time.Now()
+		attempt.err = err
+		attempt.parts = renditions
+		f.saveAttempt(segment, attempt)
+		if f.ctx.Err() != nil {
+			//cancelled, not a broadcaster failure
+			broadcasterPool.release(b)
+			return nil, errors.New("transcode cancelled")
+		}
+		//busy broadcasters are not failing, send the segment again once one has room
+		var busyErr *broadcasterBusyError
+		if errors.As(err, &busyErr) && busy < maxBusyRetries {
+			busy++
+			InfoLogger.Printf("%v segment %v: %v\n", f.RequestId, num, err.Error())
+			broadcasterPool.backoff(b, busyErr.retryAfter)
+			continue
+		}
+		tried[b] = true
+		broadcasterPool.done(b, attempt.ended.Sub(attempt.started), duration, err == nil)
+		if err != nil {
+			ErrorLogger.Printf("%v failed to transcode segment %v with %v: %v\n", f.RequestId, num, b.Url.String(), err.Error())
 			continue //try another broadcaster
 		}
-		defer resp.Body.Close()
 
-		//if http error from B move to next
-		if resp.StatusCode != 200 {
-			respBody, _ := io.ReadAll(resp.Body)
-			ErrorLogger.Printf("%v failed to send transcode %v %v to %v", f.RequestId, resp.StatusCode, string(respBody), bUrl)
-			//time.Sleep(1 * time.Second)
-			continue
+		return renditions, nil
+	}
+	if f.ctx.Err() != nil {
+		return nil, errors.New("transcode cancelled")
+	}
+
+	//every broadcaster was tried or none is available, recorded so segments waiting on the pool show up
+	now := time.Now()
+	f.saveAttempt(segment, &segmentAttempt{started: now, ended: now, err: errNoBroadcaster})
+
+	return nil, fmt.Errorf("need to retry segment: %w", errNoBroadcaster)
+}
+
+// errNoBroadcaster is the error of an attempt that found no broadcaster to send the segment to
+var errNoBroadcaster = errors.New("no broadcaster available")
+
+// postSegment streams the segment file to the broadcaster and streams the returned renditions to their part files,
+// returns the part file of each profile. The response status and bytes sent and received are recorded on the attempt.
+func (f *FfmpegTranscode) postSegment(b *Broadcaster, segment *models.Record, segF *os.File, size int64, transcodeConfig string, reqTimeout time.Duration, attempt *segmentAttempt) (map[string]string, error) {
+	segFile := segment.GetString("segfile")
+	num := segment.GetString("num")
+	segDur := segment.GetFloat("duration") * float64(1000)
+
+	bUrl := b.Url.String() + "/" + f.ManifestID + "/" + num + path.Ext(segFile)
+	ctx, cancel := context.WithTimeout(f.ctx, reqTimeout)
+	defer cancel()
+	//each attempt reads the file from the start, nothing is held in memory between attempts.
+	//bytes sent are the bytes the transport read, a body read again for a redirect counts from the start
+	sent := &countingReader{r: io.NewSectionReader(segF, 0, size)}
+	req, _ := http.NewRequestWithContext(ctx, "POST", bUrl, sent)
+	req.ContentLength = size
+	req.GetBody = func() (io.ReadCloser, error) {
+		sent = &countingReader{r: io.NewSectionReader(segF, 0, size)}
+		return io.NopCloser(sent), nil
+	}
+	defer func() { attempt.bytesSent = sent.n.Load() }()
+	if b.User != "" {
+		req.SetBasicAuth(b.User, b.Password)
+	}
+	req.Header.Add("Accept", "multipart/mixed")
+	req.Header.Add("Content-Duration", fmt.Sprintf("%d", int(math.Round(segDur))))
+	if segment.GetInt("width") > 0 && segment.GetInt("height") > 0 {
+		req.Header.Add("Content-Resolution", fmt.Sprintf("%dx%d", segment.GetInt("width"), segment.GetInt("height")))
+	}
+	req.Header.Add("Livepeer-Transcode-Configuration", transcodeConfig)
+
+	resp, rErr := broadcasterClient.Do(req)
+	if rErr != nil {
+		return nil, fmt.Errorf("failed to send request to transcode: %w", rErr)
+	}
+	defer resp.Body.Close()
+	attempt.httpStatus = resp.StatusCode
+	body := &countingReader{r: resp.Body}
+	defer func() { attempt.bytesReceived = body.n.Load() }()
+
+	if resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, &broadcasterBusyError{url: b.Url.String(), retryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+	}
+
+	//if http error from B move to next
+	if resp.StatusCode != 200 {
+		respBody, _ := io.ReadAll(io.LimitReader(body, 4096))
+		return nil, errors.New(fmt.Sprintf("failed to send transcode %v %v to %v", resp.StatusCode, string(respBody), bUrl))
+	}
+
+	mediaType, params, mErr := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	//TODO: responses were blank if not including multipart/mixed header.
+	//      should have header of application/vnd+livepeer.uri
+	if mErr != nil || mediaType != "multipart/mixed" {
+		return nil, errors.New("response header invalid")
+	}
+
+	mr := multipart.NewReader(body, params["boundary"])
+	renditions := make(map[string]string)
+
+	for {
+		part, err := mr.NextPart()
+
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("multipart reponse parsing error (could not read part, %v)", err.Error()))
+		}
+		fn := safeName(part.FileName())
 
-		if resp.StatusCode == 200 {
-			mediaType, params, mErr := mime.ParseMediaType(resp.Header.Get("Content-Type"))
-			//TODO: responses were blank if not including multipart/mixed header.
-			//      should have header of application/vnd+livepeer.uri
-			if mErr != nil || mediaType != "multipart/mixed" {
-				return f.segmentTranscodeFailed(segment, errors.New("response header invalid"))
-			}
+		if fn == "" {
+			return nil, errors.New("no filename returned with segment")
+		}
 
-			//debug - save response
-			//data, rErr := io.ReadAll(resp.Body)
-			//os.WriteFile(f.WorkDir+"/resp.body", data, 0644)
-			//os.WriteFile(f.WorkDir+"/resp.header", []byte(fmt.Sprintf("%+v", resp.Header)), 0644)
+		// Create a file to save the part's content
+		partFile := f.WorkDir + "/" + segment.GetString("transcode") + "_" + fn
+		file, err := os.Create(partFile)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("multipart reponse parsing error (could not create file for part data, %v)", err.Error()))
+		}
 
-			if rErr != nil {
-				return f.segmentTranscodeFailed(segment, errors.New("could not read response"))
-			}
+		// Copy the part's content to the file
+		_, err = io.Copy(file, part)
+		cErr := file.Close()
+		if err != nil || cErr != nil {
+			return nil, errors.New("multipart reponse parsing error (EOF)")
+		}
 
-			mr := multipart.NewReader(resp.Body, params["boundary"])
+		renditions[renditionName(part.Header.Get("Rendition-Name"), fn, num)] = partFile
+		InfoLogger.Printf("%v segment %v transcoded, rendition %v saved\n", f.RequestId, num, fn)
+	}
 
-			for {
-				part, err := mr.NextPart()
+	return renditions, nil
+}
 
-				if err == io.EOF {
-					break
-				}
-				if err != nil {
-					return f.segmentTranscodeFailed(segment, errors.New(fmt.Sprintf("multipart reponse parsing error (could not read part, %v)", err.Error())))
-				}
-				fn := part.FileName()
-				fn = strings.ReplaceAll(fn, "/", "")
-				fn = strings.ReplaceAll(fn, "..", "")
+// Transcode runs the profiles through ffmpeg on this machine, one output per profile
+func (t *localTranscoder) Transcode(segment *models.Record) (map[string]string, error) {
+	f := t.f
+	f.updateSegmentTranscodeStatus(segment, "in_progress", "transcoding locally")
 
-				if fn == "" {
-					return f.segmentTranscodeFailed(segment, errors.New("no filename returned with segment"))
-				}
+	if len(f.Request.Profiles) == 0 {
+		return nil, permanent(errors.New("no profiles to transcode"))
+	}
 
-				// Create a file to save the part's content
-				file, err := os.Create(f.WorkDir + "/" + segment.GetString("transcode") + "_" + part.FileName())
-				if err != nil {
-					return f.segmentTranscodeFailed(segment, errors.New(fmt.Sprintf("multipart reponse parsing error (could not create file for part data, %v)", err.Error())))
-				}
-				defer file.Close()
+	segFile := segment.GetString("segfile")
+	num := segment.GetString("num")
+	//keep the source timestamps like broadcaster parts do, so parts of local and broadcaster segments join without a discontinuity
+	input := ffmpeg.Input(segFile, ffmpeg.KwArgs{"copyts": ""})
+	var outputs []*ffmpeg.Stream
+	renditions := make(map[string]string)
+	for _, p := range f.Request.Profiles {
+		outFile := f.WorkDir + "/" + segment.GetString("transcode") + "_" + safeName(p.Name) + "_" + num + ".ts"
+		outputs = append(outputs, input.Output(outFile, localProfileArgs(p)))
+		renditions[p.Name] = outFile
+	}
 
-				// Copy the part's content to the file
-				_, err = io.Copy(file, part)
-				if err != nil {
-					return f.segmentTranscodeFailed(segment, errors.New("multipart reponse parsing error (EOF)"))
-				}
+	InfoLogger.Printf("%v transcoding segment %v locally", f.RequestId, segFile)
+	attempt := &segmentAttempt{broadcaster: "local", started: time.Now()}
+	err := f.runFfmpeg(ffmpeg.MergeOutputs(outputs...))
+	attempt.ended = time.Now()
+	attempt.err = err
+	if err == nil {
+		attempt.parts = renditions
+	}
+	f.saveAttempt(segment, attempt)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("local transcode failed: %v", err.Error()))
+	}
 
-				f.segmentTranscodeComplete(segment)
-				InfoLogger.Printf("%v segment %v transcoded, rendition %v saved\n", f.RequestId, segment.GetString("num"), part.FileName())
+	InfoLogger.Printf("%v segment %v transcoded locally, %v renditions saved\n", f.RequestId, num, len(outputs))
+	return renditions, nil
+}
 
-			}
+// renditionName returns the profile name of a returned part, broadcasters name parts <profile>_<num>.<ext>
+func renditionName(header string, fn string, num string) string {
+	if header != "" {
+		return header
+	}
+	name := strings.TrimSuffix(fn, path.Ext(fn))
+	return strings.TrimSuffix(name, "_"+num)
+}
 
-			return nil
+// localProfileArgs are the libx264 args for the profile, matching the pixel format and h264 profile of broadcaster parts
+// so local and broadcaster parts can be stitched together
+func localProfileArgs(p Profile) ffmpeg.KwArgs {
+	pixFmt := localPixFmt(p)
+	args := ffmpeg.KwArgs{"f": "mpegts", "c:v": "libx264", "c:a": "aac", "s": fmt.Sprintf("%dx%d", p.Width, p.Height), "pix_fmt": pixFmt}
+	if profile := localH264Profile(p, pixFmt); profile != "" {
+		args["profile:v"] = profile
+	}
+	if p.Bitrate > 0 {
+		args["b:v"] = fmt.Sprint(p.Bitrate)
+	}
+	if p.FPS > 0 {
+		fpsDen := max(p.FPSDen, 1)
+		args["r"] = fmt.Sprintf("%d/%d", p.FPS, fpsDen)
+	}
+	if p.GOP != "" {
+		if gop, err := strconv.ParseFloat(p.GOP, 64); err == nil && gop > 0 {
+			args["force_key_frames"] = fmt.Sprintf("expr:gte(t,n_forced*%v)", gop)
 		}
+	}
+
+	return args
+}
 
+// localPixFmt is the pixel format for the chroma format and color depth, broadcasters default to 8 bit 4:2:0
+func localPixFmt(p Profile) string {
+	pixFmt := "yuv420p"
+	switch {
+	case strings.Contains(p.ChromaFormat, "444"):
+		pixFmt = "yuv444p"
+	case strings.Contains(p.ChromaFormat, "422"):
+		pixFmt = "yuv422p"
+	}
+	if p.ColorDepth > 8 {
+		pixFmt += "10le"
 	}
 
-	return f.segmentTranscodeFailed(segment, errors.New("need to retry segment"))
+	return pixFmt
+}
+
+// localH264Profile is the libx264 profile for the profile name (e.g. H264High), raised to the high profile the
+// pixel format needs as libx264 rejects a profile that cannot hold it. Empty leaves the profile to libx264.
+func localH264Profile(p Profile, pixFmt string) string {
+	name := strings.TrimPrefix(strings.ToLower(p.Profile), "h264")
+	var profile string
+	switch name {
+	case "":
+		return ""
+	case "baseline", "constrainedbaseline":
+		profile = "baseline"
+	case "main":
+		profile = "main"
+	default:
+		//high and constrained high, libx264 has no constrained high
+		profile = "high"
+	}
+
+	switch {
+	case strings.HasPrefix(pixFmt, "yuv444p"):
+		return "high444"
+	case strings.HasPrefix(pixFmt, "yuv422p"):
+		return "high422"
+	case strings.HasSuffix(pixFmt, "10le"):
+		return "high10"
+	}
+
+	return profile
 }
 
 func (f *FfmpegTranscode) createTranscodeConfig() (string, error) {
@@ -490,6 +905,11 @@ func (f *FfmpegTranscode) segmentTranscodeFailed(segment *models.Record, segErr
 }
 
 func (f *FfmpegTranscode) transcodeFailed(req *models.Record, reqErr error) error {
+	//errors from stopping a cancelled transcode are not failures
+	if f.ctx.Err() != nil {
+		f.transcodeCancelled(req)
+		return reqErr
+	}
 	fails := req.GetInt("failures")
 	fails++
 	req.Set("status", "error")
@@ -506,7 +926,7 @@ func (f *FfmpegTranscode) transcodeFailed(req *models.Record, reqErr error) erro
 
 func (f *FfmpegTranscode) updateSegmentTranscodeStatus(segment *models.Record, status string, message string) {
 	segment.Set("status", status)
-	segment.Set("status_message", "transcoding")
+	segment.Set("status_message", message)
 	sErr := f.pApp.Dao().SaveRecord(segment)
 	if sErr != nil {
 		ErrorLogger.Printf("%v segment %v could not update status\n", f.RequestId, segment.Id)
@@ -523,6 +943,9 @@ func (f *FfmpegTranscode) segmentTranscodeComplete(segment *models.Record) {
 }
 
 func (f *FfmpegTranscode) updateTranscodeReqStatus(req *models.Record, status string, message string) {
+	if f.ctx.Err() != nil {
+		return
+	}
 	req.Set("status", status)
 	req.Set("status_message", message)
 	err := f.pApp.Dao().SaveRecord(req)
@@ -532,8 +955,17 @@ func (f *FfmpegTranscode) updateTranscodeReqStatus(req *models.Record, status st
 }
 
 func (f *FfmpegTranscode) transcodeComplete(req *models.Record) {
-	req.Set("status", "complete")
-	req.Set("status_message", "complete")
+	if f.ctx.Err() != nil {
+		f.transcodeCancelled(req)
+		return
+	}
+	if f.missing != nil {
+		req.Set("status", "partial")
+		req.Set("status_message", "partial, "+f.missing.summary())
+	} else {
+		req.Set("status", "complete")
+		req.Set("status_message", "complete")
+	}
 	err := f.pApp.Dao().SaveRecord(req)
 	if err != nil {
 		ErrorLogger.Printf("%v failed to save status update  error: %v\n", req.Id, err.Error())
@@ -553,6 +985,8 @@ func (f *FfmpegTranscode) saveTranscodeReq() (*models.Record, error) {
 	record.Set("status", "queued")
 	record.Set("failures", 0)
 	record.Set("user", f.User.Id)
+	record.Set("manifest_id", f.ManifestID)
+	record.Set("priority", f.Priority)
 	if err := f.pApp.Dao().SaveRecord(record); err != nil {
 		fmt.Printf("error saving transcode request: %v\n", err.Error())
 		return nil, tSaveErr
@@ -561,101 +995,87 @@ func (f *FfmpegTranscode) saveTranscodeReq() (*models.Record, error) {
 	}
 }
 
-func (f *FfmpegTranscode) newS3UploadFile() (string, error) {
+func (f *FfmpegTranscode) newS3UploadFile() (*models.Record, error) {
 	collection, err := f.pApp.Dao().FindCollectionByNameOrId("uploads")
 	if err != nil {
-		return "", err
-	}
-	fileType, err := mimetype.DetectFile(f.Request.Input.Path)
-	if err != nil {
-		return "", errors.New("could not detect file type, make sure file has appropriate extension")
-	} else {
-		if strings.Contains(fileType.String(), "video") == false {
-			return "", errors.New("file is not video, make sure file is video")
-		}
+		return nil, err
 	}
 
+	//file type is detected once the object is downloaded
 	record := models.NewRecord(collection)
 	record.Set("user", f.User.Id)
-	record.Set("localfile", f.pApp.DataDir()+"/videos/uploads/"+uuid.NewString()+fileType.Extension())
+	record.Set("localfile", f.pApp.DataDir()+"/videos/uploads/"+uuid.NewString()+path.Ext(f.Request.Input.Path))
 	record.Set("filename", f.Request.Input.Path)
-	record.Set("filetype", fileType.String())
+	record.Set("complete", false)
 
 	if err := f.pApp.Dao().SaveRecord(record); err != nil {
-		fmt.Printf("%v\n", err.Error())
-		return "", err
+		ErrorLogger.Printf("could not save upload file %v\n", err.Error())
+		return nil, err
 	} else {
-		return record.GetString("localfile"), nil
+		return record, nil
 	}
 
 }
 
-func (f *FfmpegTranscode) downloadVideo() error {
-	_, err := url.Parse(f.Request.Input.Endpoint)
+func (f *FfmpegTranscode) downloadVideo(upload *models.Record) error {
+	s3Client, err := newS3Client(f.Request.Input)
 	if err != nil {
-		fmt.Println("failed to parse endpoint url")
-		return errors.New("failed to download video: failed to parse s3 url. make sure is like https://endpoint.s3.url")
+		ErrorLogger.Printf("failed to download video, s3 connection failed: %v\n", err.Error())
+		return errors.New("failed to download video: s3 connection failed. make sure endpoint is like endpoint.s3.url or https://endpoint.s3.url")
 	}
 
-	s3Client, err := minio.New(f.Request.Input.Endpoint, &minio.Options{
-		Creds:  credentials.NewStaticV4(f.Request.Input.AuthID, f.Request.Input.AuthPW, ""),
-		Secure: true,
-	})
-
-	if err != nil {
-		fmt.Println("failed to download video, s3 connection failed")
-		return errors.New("failed to download video: s3 connection failed")
-	}
-
-	reader, err := s3Client.GetObject(context.Background(), f.Request.Input.Bucket, f.Request.Input.Path, minio.GetObjectOptions{})
+	stat, err := s3Client.StatObject(f.ctx, f.Request.Input.Bucket, f.Request.Input.Path, minio.StatObjectOptions{})
 	if err != nil {
+		ErrorLogger.Printf("failed to download video, could not stat object: %v\n", err.Error())
 		return errors.New("failed to download video: could not get object path")
 	}
-	defer reader.Close()
 
-	localFile, err := os.Create(f.UploadFile)
-	if err != nil {
-		return errors.New("failed to download video: could not create local file")
-	}
-	defer localFile.Close()
-
-	stat, err := reader.Stat()
-	if err != nil {
-		return errors.New("failed to download video: could not stat local file")
+	//download in ranges from the end of the local file so interrupted downloads resume
+	localFile := upload.GetString("localfile")
+	var dErr error
+	for attempt := 1; attempt <= 5; attempt++ {
+		dErr = downloadObjectRange(f.ctx, s3Client, f.Request.Input, localFile, stat.Size)
+		if dErr == nil {
+			break
+		}
+		ErrorLogger.Printf("%v s3 download attempt %v failed: %v\n", f.RequestId, attempt, dErr.Error())
+		if !sleepCtx(f.ctx, time.Duration(attempt*5)*time.Second) {
+			break
+		}
 	}
-
-	if _, err := io.CopyN(localFile, reader, stat.Size); err != nil {
-		return errors.New("failed to download video: failed copying s3 download to file")
+	if dErr != nil {
+		return errors.New(fmt.Sprintf("failed to download video: %v", dErr.Error()))
 	}
 
 	//file downloaded successfully
-	return nil
+	return f.completeDownload(upload)
 }
 
-func checkTranscodeRequests(app *pocketbase.PocketBase) {
+// findUploadFile returns the upload for the transcode, the latest upload of the user with the input filename if not set yet
+func (f *FfmpegTranscode) findUploadFile(req *models.Record) (*models.Record, error) {
+	if uploadId := req.GetString("upload_file"); uploadId != "" {
+		return f.pApp.Dao().FindRecordById("uploads", uploadId)
+	}
+	return f.findUserUpload()
+}
 
-	transcodes, err := app.Dao().FindRecordsByFilter("transcodes", "status = 'queued' && failures < 10", "+created", 20, 0, dbx.Params{})
+// findUserUpload returns the latest upload of the user for the input path
+func (f *FfmpegTranscode) findUserUpload() (*models.Record, error) {
+	uploadFile, err := f.pApp.Dao().FindRecordsByFilter("uploads", "filename ~ {:filename} && user={:userid}", "-created", 1, 0, dbx.Params{"filename": f.Request.Input.Path, "userid": f.User.Id})
 	if err != nil {
-		ErrorLogger.Printf("could not get queued transcodes: %v", err.Error())
-		return
+		return nil, err
 	}
-
-	broadcasters, bErr := getBroadcasters(app.DataDir())
-	if bErr != nil {
-		ErrorLogger.Printf("could not get broadcasters for processing queued transcodes: %v", bErr.Error())
-		return
+	if len(uploadFile) == 0 {
+		return nil, errors.New("upload file not found")
 	}
 
-	for _, t := range transcodes {
-		t_user := t.ExpandedOne("user")
-		nt, ntErr := NewFfmpegTranscode(app.DataDir(), t.GetString("request"), broadcasters, t_user, app)
-		if err != nil {
-			ErrorLogger.Printf("could not start transcode for %v for user %v: %v", t.GetString("filename"), t_user.Username(), ntErr.Error())
-			continue
-		}
-
-		go nt.StartTranscode()
+	return uploadFile[0], nil
+}
 
+func (f *FfmpegTranscode) setTranscodeUpload(req *models.Record, upload *models.Record) {
+	req.Set("upload_file", upload.Id)
+	if err := f.pApp.Dao().SaveRecord(req); err != nil {
+		ErrorLogger.Printf("%v could not save upload file for transcode: %v\n", req.Id, err.Error())
 	}
 }
 
@@ -673,6 +1093,22 @@ func (f *FfmpegTranscode) getFileInfo() map[string]any {
 	return pd
 }
 
+func (f *FfmpegTranscode) getDuration() float64 {
+	if f.media != nil {
+		return f.media.Duration
+	}
+	info := f.getFileInfo()
+	if info == nil {
+		return 0
+	}
+	format, ok := info["format"].(map[string]any)
+	if !ok {
+		return 0
+	}
+
+	return cast.ToFloat64(format["duration"])
+}
+
 func extFromFileType(ft string) string {
 	switch ft {
 	case "video/mp4":
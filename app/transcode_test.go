@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestLocalProfileArgs(t *testing.T) {
+	tests := []struct {
+		name    string
+		profile Profile
+		pixFmt  string
+		h264    string
+	}{
+		{"defaults", Profile{}, "yuv420p", ""},
+		{"baseline", Profile{Profile: "H264Baseline"}, "yuv420p", "baseline"},
+		{"constrained high", Profile{Profile: "H264ConstrainedHigh"}, "yuv420p", "high"},
+		{"10 bit", Profile{Profile: "H264High", ColorDepth: 10}, "yuv420p10le", "high10"},
+		{"4:2:2", Profile{Profile: "H264Main", ChromaFormat: "422"}, "yuv422p", "high422"},
+		{"4:4:4 10 bit", Profile{Profile: "H264High", ChromaFormat: "444", ColorDepth: 10}, "yuv444p10le", "high444"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := localProfileArgs(tt.profile)
+			if args["pix_fmt"] != tt.pixFmt {
+				t.Errorf("pix_fmt %v, want %v", args["pix_fmt"], tt.pixFmt)
+			}
+			if profile, _ := args["profile:v"].(string); profile != tt.h264 {
+				t.Errorf("profile:v %q, want %q", profile, tt.h264)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Transcoder transcodes a segment into a part file for each profile of the request
+type Transcoder interface {
+	Transcode(segment *models.Record) (map[string]string, error)
+}
+
+// BroadcasterClient sends requests to broadcasters, the fake broadcaster is served through it in process
+type BroadcasterClient interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// broadcasterClient is used for segment requests and health probes
+var broadcasterClient BroadcasterClient = http.DefaultClient
+
+const (
+	modeBroadcaster = "broadcaster"
+	modeLocal       = "local"
+	modeFallback    = "fallback"
+)
+
+// defaultTranscodeMode is used for requests that do not set a mode, set from the command line flags at start.
+// Local transcoding is CPU heavy so fallback to it is opt-in.
+var defaultTranscodeMode = modeBroadcaster
+
+// broadcasterTranscoder sends segments to the broadcasters in the pool
+type broadcasterTranscoder struct {
+	f *FfmpegTranscode
+}
+
+// localTranscoder transcodes segments with ffmpeg on this machine, CPU only
+type localTranscoder struct {
+	f *FfmpegTranscode
+}
+
+// fallbackTranscoder transcodes with the fallback when the primary fails, so jobs finish without the network
+type fallbackTranscoder struct {
+	f        *FfmpegTranscode
+	primary  Transcoder
+	fallback Transcoder
+}
+
+func (t *fallbackTranscoder) Transcode(segment *models.Record) (map[string]string, error) {
+	renditions, err := t.primary.Transcode(segment)
+	if err == nil || t.f.ctx.Err() != nil {
+		return renditions, err
+	}
+	InfoLogger.Printf("%v segment %v not transcoded by broadcasters (%v), transcoding locally\n", t.f.RequestId, segment.GetString("num"), err.Error())
+
+	return t.fallback.Transcode(segment)
+}
+
+func newTranscoder(f *FfmpegTranscode, mode string) Transcoder {
+	switch mode {
+	case modeBroadcaster:
+		return &broadcasterTranscoder{f: f}
+	case modeLocal:
+		return &localTranscoder{f: f}
+	}
+
+	return &fallbackTranscoder{f: f, primary: &broadcasterTranscoder{f: f}, fallback: &localTranscoder{f: f}}
+}
+
+// transcodeMode returns the mode for the request, the default mode if not set
+func transcodeMode(mode string) (string, error) {
+	if mode == "" {
+		return defaultTranscodeMode, nil
+	}
+	if err := validTranscodeMode(mode); err != nil {
+		return "", err
+	}
+
+	return mode, nil
+}
+
+func validTranscodeMode(mode string) error {
+	switch mode {
+	case modeBroadcaster, modeLocal, modeFallback:
+		return nil
+	}
+
+	return errors.New(fmt.Sprintf("transcode mode must be broadcaster, local or fallback, got %v", mode))
+}
@@ -0,0 +1,27 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "k4rn7wqe",
+    "name": "renditions",
+    "type": "json",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {}
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // remove
+  collection.schema.removeField("k4rn7wqe")
+
+  return dao.saveCollection(collection)
+})
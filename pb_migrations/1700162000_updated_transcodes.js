@@ -0,0 +1,27 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "p3vhd9sa",
+    "name": "outputs",
+    "type": "json",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {}
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // remove
+  collection.schema.removeField("p3vhd9sa")
+
+  return dao.saveCollection(collection)
+})
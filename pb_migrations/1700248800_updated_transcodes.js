@@ -0,0 +1,27 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "c8zqr1nw",
+    "name": "storage_status",
+    "type": "json",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {}
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // remove
+  collection.schema.removeField("c8zqr1nw")
+
+  return dao.saveCollection(collection)
+})
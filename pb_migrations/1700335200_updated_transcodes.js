@@ -0,0 +1,31 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "m2fs8ktd",
+    "name": "manifest_id",
+    "type": "text",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": null,
+      "max": null,
+      "pattern": ""
+    }
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // remove
+  collection.schema.removeField("m2fs8ktd")
+
+  return dao.saveCollection(collection)
+})
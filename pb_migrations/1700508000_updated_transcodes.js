@@ -0,0 +1,55 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // update
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "3hmxoumw",
+    "name": "status",
+    "type": "select",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "maxSelect": 1,
+      "values": [
+        "queued",
+        "in_progress",
+        "complete",
+        "error",
+        "cancelled",
+        "paused"
+      ]
+    }
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // update
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "3hmxoumw",
+    "name": "status",
+    "type": "select",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "maxSelect": 1,
+      "values": [
+        "queued",
+        "in_progress",
+        "complete",
+        "error",
+        "cancelled"
+      ]
+    }
+  }))
+
+  return dao.saveCollection(collection)
+})
@@ -0,0 +1,31 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "q6tjw0ra",
+    "name": "priority",
+    "type": "number",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": 0,
+      "max": 2,
+      "noDecimal": true
+    }
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("1oe3eocshms1c81")
+
+  // remove
+  collection.schema.removeField("q6tjw0ra")
+
+  return dao.saveCollection(collection)
+})
@@ -0,0 +1,31 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "a6yd3nrk",
+    "name": "attempts",
+    "type": "number",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": 0,
+      "max": null,
+      "noDecimal": true
+    }
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // remove
+  collection.schema.removeField("a6yd3nrk")
+
+  return dao.saveCollection(collection)
+})
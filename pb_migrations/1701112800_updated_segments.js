@@ -0,0 +1,69 @@
+/// <reference path="../pb_data/types.d.ts" />
+migrate((db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "w9dk4mzs",
+    "name": "width",
+    "type": "number",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": 0,
+      "max": null,
+      "noDecimal": true
+    }
+  }))
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "h2vq7nla",
+    "name": "height",
+    "type": "number",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": 0,
+      "max": null,
+      "noDecimal": true
+    }
+  }))
+
+  // add
+  collection.schema.addField(new SchemaField({
+    "system": false,
+    "id": "u5tr8cpe",
+    "name": "duration",
+    "type": "number",
+    "required": false,
+    "presentable": false,
+    "unique": false,
+    "options": {
+      "min": 0,
+      "max": null,
+      "noDecimal": false
+    }
+  }))
+
+  return dao.saveCollection(collection)
+}, (db) => {
+  const dao = new Dao(db)
+  const collection = dao.findCollectionByNameOrId("hm98un3591ksncz")
+
+  // remove
+  collection.schema.removeField("w9dk4mzs")
+
+  // remove
+  collection.schema.removeField("h2vq7nla")
+
+  // remove
+  collection.schema.removeField("u5tr8cpe")
+
+  return dao.saveCollection(collection)
+})